@@ -0,0 +1,342 @@
+package beater
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	// column kinds values, how the values of a column are converted
+	columnKindAuto    = "auto"
+	columnKindString  = "string"
+	columnKindInt     = "int"
+	columnKindFloat   = "float"
+	columnKindDecimal = "decimal"
+	columnKindBool    = "bool"
+	columnKindTime    = "time"
+	columnKindDate    = "date"
+	columnKindSeconds = "seconds"
+	columnKindBit     = "bit"
+	columnKindJSON    = "json"
+	columnKindBytes   = "bytes"
+
+	// NULL values policies values
+	nullsNull = "null"
+	nullsOmit = "omit"
+
+	// float64 holds any decimal up to 15 significant digits exactly
+	maxFloatDigits = 15
+
+	// layout of the DATETIME and TIMESTAMP values, the fractional seconds are optional
+	mysqlTimeLayout = "2006-01-02 15:04:05.999999999"
+
+	// layout of the DATE values
+	mysqlDateLayout = "2006-01-02"
+)
+
+var (
+	validColumnKinds = map[string]bool{
+		columnKindAuto:    true,
+		columnKindString:  true,
+		columnKindInt:     true,
+		columnKindFloat:   true,
+		columnKindDecimal: true,
+		columnKindBool:    true,
+		columnKindTime:    true,
+		columnKindDate:    true,
+		columnKindSeconds: true,
+		columnKindBit:     true,
+		columnKindJSON:    true,
+		columnKindBytes:   true,
+	}
+
+	// columnKindsByType maps the MySQL column types to their conversion, types not listed are strings
+	columnKindsByType = map[string]string{
+		"TINYINT":    columnKindInt,
+		"SMALLINT":   columnKindInt,
+		"MEDIUMINT":  columnKindInt,
+		"INT":        columnKindInt,
+		"BIGINT":     columnKindInt,
+		"YEAR":       columnKindInt,
+		"FLOAT":      columnKindFloat,
+		"DOUBLE":     columnKindFloat,
+		"DECIMAL":    columnKindDecimal,
+		"DATETIME":   columnKindTime,
+		"TIMESTAMP":  columnKindTime,
+		"DATE":       columnKindDate,
+		"TIME":       columnKindSeconds,
+		"BIT":        columnKindBit,
+		"JSON":       columnKindJSON,
+		"BINARY":     columnKindBytes,
+		"VARBINARY":  columnKindBytes,
+		"TINYBLOB":   columnKindBytes,
+		"BLOB":       columnKindBytes,
+		"MEDIUMBLOB": columnKindBytes,
+		"LONGBLOB":   columnKindBytes,
+		"GEOMETRY":   columnKindBytes,
+		"NULL":       columnKindAuto,
+		"":           columnKindAuto,
+	}
+)
+
+// column is a result column of a query and the conversion of its values
+type column struct {
+	name string
+	kind string
+
+	// precision and scale of a DECIMAL column, -1 when unknown
+	precision int64
+	scale     int64
+
+	// location is the time zone of the DATETIME, TIMESTAMP and DATE values
+	location *time.Location
+}
+
+// newColumns describes the result columns of a query from their type metadata, the columns option of the query
+// overrides the conversion of a column
+func newColumns(q *query, columnTypes []*sql.ColumnType) []*column {
+	columns := make([]*column, len(columnTypes))
+
+	for i, columnType := range columnTypes {
+		c := &column{
+			name:      columnType.Name(),
+			kind:      columnKindString,
+			precision: -1,
+			scale:     -1,
+			location:  q.location,
+		}
+
+		typeName := strings.TrimPrefix(strings.ToUpper(columnType.DatabaseTypeName()), "UNSIGNED ")
+		if kind, ok := columnKindsByType[typeName]; ok {
+			c.kind = kind
+		}
+
+		if precision, scale, ok := columnType.DecimalSize(); ok {
+			c.precision = precision
+			c.scale = scale
+		}
+
+		// Delta columns are counters, even when the server returns them as strings (e.g. SHOW STATUS)
+		if _, ok := q.deltaColumn(c.name); ok && c.kind != columnKindInt && c.kind != columnKindFloat {
+			c.kind = columnKindAuto
+		}
+
+		if kind, ok := q.columnKinds[c.name]; ok {
+			c.kind = kind
+		}
+
+		columns[i] = c
+	}
+
+	return columns
+}
+
+// convert returns the value of the column as the type of the event field,
+// a value that doesn't fit the column kind is returned as a string
+func (c *column) convert(raw sql.RawBytes) interface{} {
+	return convertValue(c.kind, raw, c.precision, c.scale, c.location)
+}
+
+// convertValue converts a raw value to the given kind, date and time values are read in the given time zone
+func convertValue(kind string, raw sql.RawBytes, precision int64, scale int64, location *time.Location) interface{} {
+	strValue := string(raw)
+
+	switch kind {
+	case columnKindAuto:
+		return parseAuto(strValue)
+
+	case columnKindInt:
+		if nValue, err := strconv.ParseInt(strValue, 10, 64); err == nil {
+			return nValue
+		}
+		if uValue, err := strconv.ParseUint(strValue, 10, 64); err == nil {
+			return uValue
+		}
+
+	case columnKindFloat:
+		if fValue, err := strconv.ParseFloat(strValue, 64); err == nil {
+			return fValue
+		}
+
+	case columnKindDecimal:
+		return parseDecimal(strValue, precision, scale)
+
+	case columnKindBool:
+		// BIT(1) values are a single byte
+		if len(raw) == 1 && raw[0] <= 1 {
+			return raw[0] == 1
+		}
+		if bValue, err := strconv.ParseBool(strValue); err == nil {
+			return bValue
+		}
+
+	case columnKindTime:
+		if tValue, err := time.ParseInLocation(mysqlTimeLayout, strValue, location); err == nil {
+			return common.Time(tValue)
+		}
+
+	case columnKindDate:
+		// A date is the midnight of that day
+		if tValue, err := time.ParseInLocation(mysqlDateLayout, strValue, location); err == nil {
+			return common.Time(tValue)
+		}
+
+	case columnKindSeconds:
+		// A TIME is an elapsed time as much as a time of day, it's sent as a number of seconds
+		if seconds, ok := parseTimeSeconds(strValue); ok {
+			return seconds
+		}
+
+	case columnKindBit:
+		if len(raw) <= 8 {
+			var uValue uint64
+			for _, b := range raw {
+				uValue = uValue<<8 | uint64(b)
+			}
+			return uValue
+		}
+
+	case columnKindJSON:
+		var jsonValue interface{}
+		if err := json.Unmarshal(raw, &jsonValue); err == nil {
+			return jsonValue
+		}
+
+	case columnKindBytes:
+		if !utf8.Valid(raw) {
+			return base64.StdEncoding.EncodeToString(raw)
+		}
+	}
+
+	return strValue
+}
+
+// parseAuto guesses the type of a value without metadata: an int64, a uint64 (counters over the int64 range),
+// a float64 or a string. Numbers with leading zeros (e.g. zip codes) are kept as strings.
+func parseAuto(strValue string) interface{} {
+	if len(strValue) > 1 && strValue[0] == '0' && strValue[1] != '.' {
+		return strValue
+	}
+
+	if nValue, err := strconv.ParseInt(strValue, 10, 64); err == nil {
+		return nValue
+	}
+
+	if uValue, err := strconv.ParseUint(strValue, 10, 64); err == nil {
+		return uValue
+	}
+
+	if fValue, err := strconv.ParseFloat(strValue, 64); err == nil {
+		return fValue
+	}
+
+	return strValue
+}
+
+// parseTimeSeconds returns a TIME value ([-]hhh:mm:ss[.fraction]) as a number of seconds,
+// an int64 without fractional seconds and a float64 otherwise
+func parseTimeSeconds(strValue string) (interface{}, bool) {
+	negative := strings.HasPrefix(strValue, "-")
+	parts := strings.Split(strings.TrimPrefix(strValue, "-"), ":")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	hours, errHours := strconv.ParseInt(parts[0], 10, 64)
+	minutes, errMinutes := strconv.ParseInt(parts[1], 10, 64)
+	if errHours != nil || errMinutes != nil || minutes > 59 {
+		return nil, false
+	}
+
+	secondsPart, fraction := parts[2], ""
+	if i := strings.IndexByte(secondsPart, '.'); i >= 0 {
+		secondsPart, fraction = secondsPart[:i], secondsPart[i:]
+	}
+	seconds, err := strconv.ParseInt(secondsPart, 10, 64)
+	if err != nil || seconds > 59 {
+		return nil, false
+	}
+
+	total := hours*3600 + minutes*60 + seconds
+	if negative {
+		total = -total
+	}
+
+	if strings.Trim(fraction, ".0") == "" {
+		return total, true
+	}
+
+	fValue, err := strconv.ParseFloat("0"+fraction, 64)
+	if err != nil {
+		return nil, false
+	}
+	if negative {
+		return float64(total) - fValue, true
+	}
+	return float64(total) + fValue, true
+}
+
+// parseDecimal returns a DECIMAL value as an int64 when it has no scale, as a float64 when it fits
+// without losing precision and as a string otherwise
+func parseDecimal(strValue string, precision int64, scale int64) interface{} {
+	if scale == 0 {
+		if nValue, err := strconv.ParseInt(strValue, 10, 64); err == nil {
+			return nValue
+		}
+	}
+
+	if precision < 0 {
+		precision = significantDigits(strValue)
+	}
+
+	if precision <= maxFloatDigits {
+		if fValue, err := strconv.ParseFloat(strValue, 64); err == nil {
+			return fValue
+		}
+	}
+
+	return strValue
+}
+
+// significantDigits counts the digits of a number, leading zeros excluded
+func significantDigits(strValue string) int64 {
+	var digits int64
+	for _, r := range strValue {
+		if r >= '1' && r <= '9' || r == '0' && digits > 0 {
+			digits++
+		}
+	}
+	return digits
+}
+
+// validateColumnKinds checks the columns option of a query
+func validateColumnKinds(columnKinds map[string]string) error {
+	for name, kind := range columnKinds {
+		if !validColumnKinds[kind] {
+			return fmt.Errorf("column %s has an unknown type '%s'", name, kind)
+		}
+	}
+	return nil
+}
+
+// nullValue returns the value of a NULL column according to the nulls policy of the query,
+// ok is false when the column must be omitted
+func (q *query) nullValue(name string, c *column) (interface{}, bool) {
+	if defaultValue, ok := q.nullDefaults[name]; ok {
+		return convertValue(c.kind, sql.RawBytes(defaultValue), c.precision, c.scale, c.location), true
+	}
+
+	if q.nulls == nullsOmit {
+		return nil, false
+	}
+
+	return nil, true
+}
@@ -0,0 +1,81 @@
+package beater
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+func TestConvertValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      string
+		raw       string
+		precision int64
+		scale     int64
+		value     interface{}
+	}{
+		{"varchar", columnKindString, "00123", -1, -1, "00123"},
+		{"auto leading zero", columnKindAuto, "00123", -1, -1, "00123"},
+		{"auto zero", columnKindAuto, "0", -1, -1, int64(0)},
+		{"auto fraction", columnKindAuto, "0.5", -1, -1, float64(0.5)},
+		{"auto negative", columnKindAuto, "-42", -1, -1, int64(-42)},
+		{"auto unsigned over int64", columnKindAuto, "18446744073709551610", -1, -1, uint64(18446744073709551610)},
+		{"auto text", columnKindAuto, "ON", -1, -1, "ON"},
+		{"int", columnKindInt, "-42", -1, -1, int64(-42)},
+		{"unsigned bigint", columnKindInt, "18446744073709551615", -1, -1, uint64(18446744073709551615)},
+		{"int not a number", columnKindInt, "abc", -1, -1, "abc"},
+		{"float", columnKindFloat, "1.5e3", -1, -1, float64(1500)},
+		{"decimal 15 digits", columnKindDecimal, "1234567890123.45", 15, 2, float64(1234567890123.45)},
+		{"decimal 16 digits", columnKindDecimal, "12345678901234.56", 16, 2, "12345678901234.56"},
+		{"decimal scale 0", columnKindDecimal, "1234567890123456789", 19, 0, int64(1234567890123456789)},
+		{"decimal scale 0 over int64", columnKindDecimal, "12345678901234567890", 20, 0, "12345678901234567890"},
+		{"decimal unknown precision", columnKindDecimal, "0.000123", -1, -1, float64(0.000123)},
+		{"decimal unknown precision 16 digits", columnKindDecimal, "1234567890.123456", -1, -1, "1234567890.123456"},
+		{"time", columnKindSeconds, "01:30:00", -1, -1, int64(5400)},
+		{"time over 24h", columnKindSeconds, "838:59:59", -1, -1, int64(3020399)},
+		{"negative time", columnKindSeconds, "-01:30:00", -1, -1, int64(-5400)},
+		{"fractional time", columnKindSeconds, "00:00:01.500000", -1, -1, float64(1.5)},
+		{"negative fractional time", columnKindSeconds, "-00:00:01.250000", -1, -1, float64(-1.25)},
+		{"fractional time without fraction", columnKindSeconds, "00:00:01.000000", -1, -1, int64(1)},
+		{"invalid time", columnKindSeconds, "12:60:00", -1, -1, "12:60:00"},
+		{"bit(1)", columnKindBit, "\x01", -1, -1, uint64(1)},
+		{"bit(16)", columnKindBit, "\x01\x00", -1, -1, uint64(256)},
+		{"bool bit(1)", columnKindBool, "\x00", -1, -1, false},
+		{"bool", columnKindBool, "true", -1, -1, true},
+		{"json", columnKindJSON, `{"a":[1,"b"]}`, -1, -1, map[string]interface{}{"a": []interface{}{float64(1), "b"}}},
+		{"invalid json", columnKindJSON, `{"a"`, -1, -1, `{"a"`},
+		{"text bytes", columnKindBytes, "abc", -1, -1, "abc"},
+		{"binary bytes", columnKindBytes, "\xff\x00", -1, -1, "/wA="},
+		{"datetime", columnKindTime, "2020-01-02 03:04:05.5", -1, -1, common.Time(time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.UTC))},
+		{"date", columnKindDate, "2020-01-02", -1, -1, common.Time(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))},
+		{"zero date", columnKindDate, "0000-00-00", -1, -1, "0000-00-00"},
+	}
+
+	for _, test := range tests {
+		value := convertValue(test.kind, []byte(test.raw), test.precision, test.scale, time.UTC)
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s: convertValue(%s, %q) = %#v, want %#v", test.name, test.kind, test.raw, value, test.value)
+		}
+	}
+}
+
+func TestSignificantDigits(t *testing.T) {
+	tests := []struct {
+		value  string
+		digits int64
+	}{
+		{"0", 0},
+		{"0.000123", 3},
+		{"-1200.50", 6},
+		{"1234567890.123456", 16},
+	}
+
+	for _, test := range tests {
+		if digits := significantDigits(test.value); digits != test.digits {
+			t.Errorf("significantDigits(%q) = %d, want %d", test.value, digits, test.digits)
+		}
+	}
+}
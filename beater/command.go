@@ -0,0 +1,49 @@
+package beater
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/elastic/beats/libbeat/cfgfile"
+
+	"mysqlbeat/config"
+)
+
+// defaultDataDir is the directory of the state files without a datapath, next to the binary
+const defaultDataDir = "data"
+
+// binaryDir is the directory of the binary, like libbeat resolves it to find its configuration file
+func binaryDir() string {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// defaultConfigFile is the configuration file libbeat reads by default, next to the binary
+func defaultConfigFile() string {
+	return filepath.Join(binaryDir(), "mysqlbeat.yml")
+}
+
+// defaultDataPath is the directory of the state files without a datapath, the data directory next to the binary
+// (a packaged install runs from /, the current directory is no place for them)
+func defaultDataPath() string {
+	return filepath.Join(binaryDir(), defaultDataDir)
+}
+
+// newCommandBeat reads the configuration of a subcommand, the defaults are set like Setup does
+// so the subcommand works on the state files of the beat
+func newCommandBeat(configFile string) (*Mysqlbeat, error) {
+	bt := New()
+	bt.beatConfig = &config.Config{}
+	if err := cfgfile.Read(bt.beatConfig, configFile); err != nil {
+		return nil, fmt.Errorf("Error reading config file: %v", err)
+	}
+
+	if err := bt.setupDefaults(); err != nil {
+		return nil, err
+	}
+	return bt, nil
+}
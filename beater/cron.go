@@ -0,0 +1,205 @@
+package beater
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule runs a job on a standard 5 fields cron expression (minute hour day-of-month month day-of-week),
+// in the local time zone
+type cronSchedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+
+	// when both day fields are restricted, a day matches if any of them matches (like cron does)
+	domStar bool
+	dowStar bool
+}
+
+// cron fields bounds
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var (
+	cronFields = []cronField{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// parseCron parses a cron expression, the @hourly/@daily/... descriptors are supported
+func parseCron(expr string) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[spec]; ok {
+		spec = descriptor
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression '%s' must have %d fields", expr, len(cronFields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression '%s': %v", expr, err)
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	s := &cronSchedule{
+		expr:    expr,
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression '%s' never matches", expr)
+	}
+
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of *, n, n-m with an optional /step into a bit set
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s field '%s'", bounds.name, part)
+			}
+		}
+
+		start, end := bounds.min, bounds.max
+		if rangePart != "*" {
+			var err error
+			values := strings.SplitN(rangePart, "-", 2)
+			start, err = strconv.Atoi(values[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field '%s'", bounds.name, part)
+			}
+			end = start
+			if len(values) == 2 {
+				end, err = strconv.Atoi(values[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid range in %s field '%s'", bounds.name, part)
+				}
+			} else if step > 1 {
+				// n/step means from n to the end of the range
+				end = bounds.max
+			}
+		}
+
+		if start < bounds.min || end > bounds.max || start > end {
+			return 0, fmt.Errorf("%s field '%s' is out of range %d-%d", bounds.name, part, bounds.min, bounds.max)
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	// Start on the next whole minute
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Give up after 5 years, the expression can't match (e.g. February 31st), parseCron rejects such expressions
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// minInterval returns the shortest interval between the next runs of the schedule after t
+func (s *cronSchedule) minInterval(t time.Time, runs int) time.Duration {
+	var interval time.Duration
+	previous := s.Next(t)
+	for i := 0; i < runs && !previous.IsZero(); i++ {
+		next := s.Next(previous)
+		if next.IsZero() {
+			break
+		}
+		if gap := next.Sub(previous); interval == 0 || gap < interval {
+			interval = gap
+		}
+		previous = next
+	}
+	return interval
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+func (s *cronSchedule) String() string {
+	return fmt.Sprintf("cron '%s'", s.expr)
+}
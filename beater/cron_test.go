@@ -0,0 +1,116 @@
+package beater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0,30 * 1,15 * *", true},
+		{"0 0 * * 7", true},
+		{"@hourly", true},
+		{" @daily ", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"1-a * * * *", false},
+		{"@weekly2", false},
+		{"0 0 31 2 *", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseCron(test.expr)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("parseCron(%q) error = %v, want ok %v", test.expr, err, test.ok)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		expr string
+		from string
+		next string
+	}{
+		// Always the next whole minute, never the current one
+		{"* * * * *", "2020-01-01 10:00", "2020-01-01 10:01"},
+		{"*/15 * * * *", "2020-01-01 10:07", "2020-01-01 10:15"},
+		{"*/15 * * * *", "2020-01-01 10:45", "2020-01-01 11:00"},
+		{"5/20 * * * *", "2020-01-01 10:26", "2020-01-01 10:45"},
+		{"0 2 * * *", "2020-01-01 02:00", "2020-01-02 02:00"},
+		{"@hourly", "2020-01-01 23:30", "2020-01-02 00:00"},
+		{"@monthly", "2020-01-15 00:00", "2020-02-01 00:00"},
+		{"@yearly", "2020-06-01 00:00", "2021-01-01 00:00"},
+		// 2020-01-04 is a Saturday
+		{"0 9 * * 1-5", "2020-01-04 08:00", "2020-01-06 09:00"},
+		// Sunday is 0 and 7
+		{"0 0 * * 7", "2020-01-01 00:00", "2020-01-05 00:00"},
+		{"0 0 * * 0", "2020-01-01 00:00", "2020-01-05 00:00"},
+		// Both day fields restricted: either of them matches
+		{"0 0 15 * 0", "2020-01-01 00:00", "2020-01-05 00:00"},
+		{"0 0 2 * 0", "2020-01-01 00:00", "2020-01-02 00:00"},
+		// Day of month restricted only
+		{"0 0 29 2 *", "2020-03-01 00:00", "2024-02-29 00:00"},
+		{"30 12 31 * *", "2020-04-01 00:00", "2020-05-31 12:30"},
+	}
+
+	for _, test := range tests {
+		s, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+
+		if next := s.Next(at(test.from)); !next.Equal(at(test.next)) {
+			t.Errorf("%q next after %s = %s, want %s", test.expr, test.from, next.Format("2006-01-02 15:04"), test.next)
+		}
+	}
+}
+
+func TestCronMinInterval(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr     string
+		interval time.Duration
+	}{
+		{"* * * * *", time.Minute},
+		{"*/5 9-17 * * 1-5", 5 * time.Minute},
+		{"0 2 * * *", 24 * time.Hour},
+		{"0 0,6 * * *", 6 * time.Hour},
+		{"@weekly", 7 * 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		s, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", test.expr, err)
+			continue
+		}
+
+		if interval := s.minInterval(from, cronIntervalRuns); interval != test.interval {
+			t.Errorf("%q min interval = %v, want %v", test.expr, interval, test.interval)
+		}
+	}
+}
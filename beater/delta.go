@@ -0,0 +1,474 @@
+package beater
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// Delta counter reset detections
+	resetDetectionDecrease = "decrease"
+	resetDetectionUptime   = "uptime"
+	resetDetectionNone     = "none"
+
+	// Delta modes: per-second rate, per-minute rate, difference since the previous value and signed change of a gauge
+	deltaModeRate      = "rate"
+	deltaModePerMinute = "perminute"
+	deltaModeDiff      = "diff"
+	deltaModeChange    = "change"
+
+	// fieldCounterReset marks the events with a delta computed over a counter reset
+	fieldCounterReset = "counter_reset"
+)
+
+var (
+	deltaKeysEvicted = expvar.NewInt("mysqlbeat.delta.evicted")
+	deltaKeysDropped = expvar.NewInt("mysqlbeat.delta.dropped")
+
+	// deltaModeSuffixes select the delta mode of a column when they follow the delta wildcard,
+	// they are also the suffixes of the flat delta field names
+	deltaModeSuffixes = map[string]string{
+		deltaModeRate:      "_PERSECOND",
+		deltaModePerMinute: "_PERMINUTE",
+		deltaModeDiff:      "_DIFF",
+		deltaModeChange:    "_CHANGE",
+	}
+)
+
+// deltaValue is the last value read for a delta column and the time it was read,
+// cycle is the delta cycle of the query it was last seen in
+type deltaValue struct {
+	value interface{}
+	age   time.Time
+	cycle uint64
+}
+
+// deltaStore holds the last value of every delta column, it's safe for concurrent use
+type deltaStore struct {
+	mu sync.Mutex
+
+	// values holds the values by owner (the host query that read them) and key,
+	// so the keys of a query are expired without going through the keys of all the others
+	values map[string]map[string]deltaValue
+
+	// dropped counts the new keys dropped since the last expire of an owner
+	dropped map[string]int
+}
+
+func newDeltaStore() *deltaStore {
+	return &deltaStore{
+		values:  map[string]map[string]deltaValue{},
+		dropped: map[string]int{},
+	}
+}
+
+// swap saves the current value of a key and returns the previous one (if any),
+// a new key is dropped when its owner already has maxKeys keys
+func (s *deltaStore) swap(owner string, cycle uint64, maxKeys int, key string, value interface{}, age time.Time) (deltaValue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values, ok := s.values[owner]
+	if !ok {
+		values = map[string]deltaValue{}
+		s.values[owner] = values
+	}
+
+	old, exists := values[key]
+	if !exists && maxKeys > 0 && len(values) >= maxKeys {
+		s.dropped[owner]++
+		return old, false
+	}
+
+	values[key] = deltaValue{value: value, age: age, cycle: cycle}
+	return old, exists
+}
+
+// expire removes the keys of an owner not seen for more than ttl cycles (if ttl is set),
+// it returns the number of keys removed and the number of new keys dropped since the last expire
+func (s *deltaStore) expire(owner string, cycle uint64, ttl int) (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := 0
+	if ttl > 0 {
+		values := s.values[owner]
+		for key, v := range values {
+			if v.cycle+uint64(ttl) < cycle {
+				delete(values, key)
+				evicted++
+			}
+		}
+	}
+
+	dropped := s.dropped[owner]
+	delete(s.dropped, owner)
+	return evicted, dropped
+}
+
+// deltaOwner returns the owner of the delta keys of a host query, it prefixes all of its keys
+func deltaOwner(h *host, q *query) string {
+	return deltaKey(h.name, q.name)
+}
+
+// deltaKey joins the parts of a delta key, every part is quoted so different parts never make the same key
+// (e.g. "ab"|"c" and "a"|"bc")
+func deltaKey(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		quoted[i] = strconv.Quote(part)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// splitDeltaKey returns the parts of a delta key, unquoted parts (NULL delta key values) are returned as is
+func splitDeltaKey(key string) []string {
+	var parts []string
+	for len(key) > 0 {
+		end := strings.Index(key, "|")
+		if key[0] == '"' {
+			// Find the closing quote, skipping the escaped characters
+			for i := 1; i < len(key); i++ {
+				if key[i] == '\\' {
+					i++
+				} else if key[i] == '"' {
+					end = i + 1
+					break
+				}
+			}
+		}
+		if end < 0 || end > len(key) {
+			end = len(key)
+		}
+
+		part := key[:end]
+		if unquoted, err := strconv.Unquote(part); err == nil {
+			part = unquoted
+		}
+		parts = append(parts, part)
+
+		key = strings.TrimPrefix(key[end:], "|")
+	}
+	return parts
+}
+
+// expireDeltas ends the delta cycle of a successful query run, the keys it didn't see for more than the key ttl
+// are evicted and a warning is logged when the query reached its max keys
+func (bt *Mysqlbeat) expireDeltas(h *host, q *query) {
+	cycle := q.nextDeltaCycle()
+
+	evicted, dropped := bt.deltas.expire(deltaOwner(h, q), cycle, q.deltaKeyTTL)
+	if evicted > 0 {
+		deltaKeysEvicted.Add(int64(evicted))
+		logp.Debug("mysqlbeat", "Host %v query %v evicted %d delta keys", h.name, q.name, evicted)
+	}
+
+	if dropped > 0 {
+		deltaKeysDropped.Add(int64(dropped))
+		logp.Warn("Host %v query %v reached its %d delta keys (maxkeys), %d new keys were not tracked", h.name, q.name, q.deltaMaxKeys, dropped)
+	}
+}
+
+// deltaResult is the delta of a column, reset is true when the counter was reset since the previous value,
+// interval is the time the delta was computed over
+type deltaResult struct {
+	value    interface{}
+	reset    bool
+	interval time.Duration
+}
+
+// deltaField is the event field of a delta column, base is the column name without the delta wildcard
+// (both in the field case of the query)
+type deltaField struct {
+	name string
+	base string
+	mode string
+}
+
+// deltaColumn returns the event field of a column, ok is false when it isn't a delta column.
+// A column ending with the delta wildcard (optionally followed by the suffix of a mode) is a delta column,
+// the delta modes of the config override the mode of a column (by its name or its name without the wildcard).
+func (q *query) deltaColumn(name string) (deltaField, bool) {
+	base := name
+	mode := ""
+
+	if q.deltaWildcard != "" {
+		if strings.HasSuffix(name, q.deltaWildcard) {
+			base, mode = strings.TrimSuffix(name, q.deltaWildcard), deltaModeRate
+		} else {
+			for m, suffix := range deltaModeSuffixes {
+				if strings.HasSuffix(name, q.deltaWildcard+suffix) {
+					base, mode = strings.TrimSuffix(name, q.deltaWildcard+suffix), m
+					break
+				}
+			}
+		}
+	}
+
+	if configured, ok := q.deltaModes[name]; ok {
+		mode = configured
+	} else if configured, ok := q.deltaModes[base]; ok && mode != "" {
+		mode = configured
+	}
+
+	if mode == "" {
+		return deltaField{name: q.fieldName(name), base: q.fieldName(name)}, false
+	}
+
+	base = q.fieldName(base)
+	return deltaField{name: q.deltaFieldName(mode, base), base: base, mode: mode}, true
+}
+
+// putDelta adds a delta column to an event, its delta (if ok) and when the query sends them its raw value
+// and the interval of the delta. A NULL value has no delta.
+func (q *query) putDelta(event common.MapStr, field deltaField, value interface{}, result deltaResult, ok bool) {
+	if q.deltaRaw {
+		putField(event, q.deltaFieldName(deltaFieldRaw, field.base), value)
+	}
+
+	if !ok {
+		return
+	}
+
+	putField(event, field.name, result.value)
+	if result.reset {
+		event[fieldCounterReset] = true
+	}
+	if q.deltaRaw && result.interval > 0 {
+		putField(event, q.deltaFieldName(deltaFieldInterval, field.base), result.interval.Seconds())
+	}
+}
+
+// calculateDelta saves the current value of a delta column and returns its delta since the previous value
+// according to the delta mode, there is no delta the first time a key is seen. key is the delta key of the column
+// within the host query.
+func (bt *Mysqlbeat) calculateDelta(h *host, q *query, key string, mode string, value interface{}, rowAge time.Time) (deltaResult, bool) {
+	owner := deltaOwner(h, q)
+	old, exists := bt.deltas.swap(owner, q.currentDeltaCycle(), q.deltaMaxKeys, owner+"|"+key, value, rowAge)
+	if !exists {
+		return deltaResult{}, false
+	}
+
+	// Gauges may go up and down, their change is signed and never a reset
+	if mode == deltaModeChange {
+		return deltaResult{value: signedChange(old.value, value), interval: rowAge.Sub(old.age)}, true
+	}
+
+	diff, delta, reset := counterDiff(h, q, old, value, rowAge)
+	result := deltaResult{reset: reset, interval: delta}
+
+	switch d := diff.(type) {
+	case uint64:
+		switch mode {
+		case deltaModeDiff:
+			if d > math.MaxInt64 {
+				result.value = d
+			} else {
+				result.value = int64(d)
+			}
+		case deltaModePerMinute:
+			// Calculate the delta and round the calculated result back to an int64
+			result.value = roundF2I(float64(d)/delta.Minutes(), .5)
+		default:
+			result.value = roundF2I(float64(d)/delta.Seconds(), .5)
+		}
+		return result, true
+
+	case float64:
+		switch mode {
+		case deltaModeDiff:
+			result.value = d
+		case deltaModePerMinute:
+			result.value = d / delta.Minutes()
+		default:
+			result.value = d / delta.Seconds()
+		}
+		return result, true
+	}
+
+	// Not a number, the value is sent as is
+	return deltaResult{value: value}, true
+}
+
+// counterDiff returns how much a counter grew since its previous value (an uint64 for integers, a float64 for floats)
+// and the interval it grew over. A reset counter grew from 0, a decreasing counter (with no detected reset) didn't grow.
+func counterDiff(h *host, q *query, old deltaValue, value interface{}, rowAge time.Time) (interface{}, time.Duration, bool) {
+	delta := rowAge.Sub(old.age)
+
+	// With the uptime detection a reset is known for sure, the counter grew since the reset
+	if q.resetDetection == resetDetectionUptime {
+		if resetAt, ok := h.countersResetAfter(old.age); ok {
+			if sinceReset := rowAge.Sub(resetAt); sinceReset > 0 {
+				delta = sinceReset
+			}
+			return sinceZero(value), delta, true
+		}
+	}
+
+	switch colValue := value.(type) {
+	case int64, uint64:
+		diff, decreased, ok := intDiff(old.value, colValue)
+		if !ok {
+			return uint64(0), delta, false
+		}
+
+		// A decreased counter wrapped around the unsigned 64-bit range
+		if !decreased || q.wraparound {
+			return diff, delta, false
+		}
+
+		if q.resetDetection == resetDetectionDecrease {
+			return sinceZero(value), delta, true
+		}
+		return uint64(0), delta, false
+
+	case float64:
+		oldVal, _ := old.value.(float64)
+		if colValue > oldVal {
+			return colValue - oldVal, delta, false
+		}
+
+		if colValue < oldVal && q.resetDetection == resetDetectionDecrease {
+			return sinceZero(value), delta, true
+		}
+		return float64(0), delta, false
+	}
+
+	return value, delta, false
+}
+
+// sinceZero returns how much a reset counter grew since it started again from 0
+func sinceZero(value interface{}) interface{} {
+	switch colValue := value.(type) {
+	case int64:
+		if colValue < 0 {
+			return uint64(0)
+		}
+		return uint64(colValue)
+	case float64:
+		if colValue < 0 {
+			return float64(0)
+		}
+	}
+	return value
+}
+
+// signedChange returns the difference between two gauge values, it may be negative
+func signedChange(oldValue, newValue interface{}) interface{} {
+	oldInt, oldIsInt := oldValue.(int64)
+	newInt, newIsInt := newValue.(int64)
+	if oldIsInt && newIsInt {
+		return newInt - oldInt
+	}
+
+	oldFloat, oldOk := toFloat(oldValue)
+	newFloat, newOk := toFloat(newValue)
+	if !oldOk || !newOk {
+		// Not a number, the value is sent as is
+		return newValue
+	}
+	return newFloat - oldFloat
+}
+
+// toFloat returns a numeric value as a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// calculateRatios adds the ratios of the query to an event, a ratio divides the growth of two counters
+// since the previous values. values holds the column values by column name, rowKey the delta key of the row (if any).
+func (bt *Mysqlbeat) calculateRatios(h *host, q *query, event common.MapStr, values map[string]interface{}, rowKey string, rowAge time.Time) {
+	keyPrefix := ""
+	if rowKey != "" {
+		keyPrefix = rowKey + "|"
+	}
+
+	for _, ratio := range q.deltaRatios {
+		numerator, numOk := values[ratio.Numerator]
+		denominator, denOk := values[ratio.Denominator]
+		if !numOk || !denOk || numerator == nil || denominator == nil {
+			continue
+		}
+
+		num, numOk := bt.calculateDelta(h, q, keyPrefix+deltaKey(ratio.Name, ratio.Numerator), deltaModeDiff, numerator, rowAge)
+		den, denOk := bt.calculateDelta(h, q, keyPrefix+deltaKey(ratio.Name, ratio.Denominator), deltaModeDiff, denominator, rowAge)
+		if !numOk || !denOk {
+			continue
+		}
+
+		numFloat, numOk := toFloat(num.value)
+		denFloat, denOk := toFloat(den.value)
+		if !numOk || !denOk || denFloat == 0 {
+			// Nothing to divide, the ratio is unknown
+			event[ratio.Name] = nil
+			continue
+		}
+
+		event[ratio.Name] = numFloat / denFloat
+		if num.reset || den.reset {
+			event[fieldCounterReset] = true
+		}
+	}
+}
+
+// intDiff returns the difference between two integer values modulo 2^64 and whether the value decreased,
+// the values may be read as int64 or uint64 depending on their size
+func intDiff(oldValue, newValue interface{}) (uint64, bool, bool) {
+	switch newVal := newValue.(type) {
+	case int64:
+		switch oldVal := oldValue.(type) {
+		case int64:
+			return uint64(newVal) - uint64(oldVal), newVal < oldVal, true
+		case uint64:
+			return uint64(newVal) - oldVal, newVal < 0 || uint64(newVal) < oldVal, true
+		}
+	case uint64:
+		switch oldVal := oldValue.(type) {
+		case int64:
+			return newVal - uint64(oldVal), oldVal >= 0 && newVal < uint64(oldVal), true
+		case uint64:
+			return newVal - oldVal, newVal < oldVal, true
+		}
+	}
+	return 0, false, false
+}
+
+// refreshCountersReset reads the time the status counters of the host were last reset,
+// by a restart or a FLUSH STATUS
+func (h *host) refreshCountersReset(ctx context.Context, conn *sql.Conn) error {
+	var name string
+	var uptime int64
+	err := conn.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Uptime_since_flush_status'").Scan(&name, &uptime)
+	if err != nil {
+		return err
+	}
+
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	h.countersReset = time.Now().Add(-time.Duration(uptime) * time.Second)
+	return nil
+}
+
+// countersResetAfter returns the time the status counters were reset if it's after t
+func (h *host) countersResetAfter(t time.Time) (time.Time, bool) {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	return h.countersReset, !h.countersReset.IsZero() && h.countersReset.After(t)
+}
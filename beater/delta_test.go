@@ -0,0 +1,183 @@
+package beater
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIntDiff(t *testing.T) {
+	tests := []struct {
+		name      string
+		old, new  interface{}
+		diff      uint64
+		decreased bool
+		ok        bool
+	}{
+		{"int growth", int64(10), int64(25), 15, false, true},
+		{"int decrease", int64(25), int64(10), math.MaxUint64 - 14, true, true},
+		{"uint growth", uint64(10), uint64(25), 15, false, true},
+		{"uint wraparound", uint64(math.MaxUint64 - 4), uint64(5), 10, true, true},
+		{"int to uint", int64(math.MaxInt64), uint64(math.MaxInt64 + 10), 10, false, true},
+		{"uint to int", uint64(math.MaxInt64 + 10), int64(5), math.MaxInt64 - 3, true, true},
+		{"negative int to uint", int64(-1), uint64(5), 6, false, true},
+		{"int to negative int", int64(5), int64(-1), math.MaxUint64 - 5, true, true},
+		{"float", float64(1), int64(2), 0, false, false},
+		{"string", int64(1), "2", 0, false, false},
+	}
+
+	for _, test := range tests {
+		diff, decreased, ok := intDiff(test.old, test.new)
+		if diff != test.diff || decreased != test.decreased || ok != test.ok {
+			t.Errorf("%s: intDiff(%v, %v) = %v, %v, %v, want %v, %v, %v", test.name, test.old, test.new,
+				diff, decreased, ok, test.diff, test.decreased, test.ok)
+		}
+	}
+}
+
+func TestCounterDiff(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(10 * time.Second)
+
+	tests := []struct {
+		name           string
+		resetDetection string
+		wraparound     bool
+		old, new       interface{}
+		diff           interface{}
+		reset          bool
+	}{
+		{"growth", resetDetectionDecrease, false, int64(100), int64(150), uint64(50), false},
+		{"reset", resetDetectionDecrease, false, int64(100), int64(20), uint64(20), true},
+		{"wraparound", resetDetectionDecrease, true, uint64(math.MaxUint64 - 9), uint64(10), uint64(20), false},
+		{"wraparound to int", resetDetectionDecrease, true, uint64(math.MaxUint64 - 5), int64(5), uint64(11), false},
+		{"int growth over int64", resetDetectionDecrease, false, int64(math.MaxInt64 - 1), uint64(math.MaxInt64 + 3), uint64(4), false},
+		{"decrease without detection", resetDetectionNone, false, int64(100), int64(20), uint64(0), false},
+		{"float growth", resetDetectionDecrease, false, float64(1.5), float64(4), float64(2.5), false},
+		{"float reset", resetDetectionDecrease, false, float64(4), float64(1.5), float64(1.5), true},
+		{"float decrease without detection", resetDetectionNone, false, float64(4), float64(1.5), float64(0), false},
+		{"negative reset", resetDetectionDecrease, false, int64(100), int64(-5), uint64(0), true},
+	}
+
+	for _, test := range tests {
+		q := &query{resetDetection: test.resetDetection, wraparound: test.wraparound}
+		old := deltaValue{value: test.old, age: start}
+
+		diff, interval, reset := counterDiff(&host{}, q, old, test.new, now)
+		if !reflect.DeepEqual(diff, test.diff) || reset != test.reset || interval != 10*time.Second {
+			t.Errorf("%s: counterDiff(%v, %v) = %#v, %v, %v, want %#v, 10s, %v", test.name, test.old, test.new,
+				diff, interval, reset, test.diff, test.reset)
+		}
+	}
+}
+
+func TestCounterDiffUptimeReset(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(10 * time.Second)
+	q := &query{resetDetection: resetDetectionUptime}
+
+	// The counters were reset 4s ago, they grew since then even if the value is higher than the old one
+	h := &host{countersReset: now.Add(-4 * time.Second)}
+	diff, interval, reset := counterDiff(h, q, deltaValue{value: int64(10), age: start}, int64(40), now)
+	if diff != uint64(40) || interval != 4*time.Second || !reset {
+		t.Errorf("counterDiff after a reset = %#v, %v, %v, want 40, 4s, true", diff, interval, reset)
+	}
+
+	// A reset before the old value doesn't matter
+	h = &host{countersReset: start.Add(-time.Hour)}
+	diff, interval, reset = counterDiff(h, q, deltaValue{value: int64(10), age: start}, int64(40), now)
+	if diff != uint64(30) || interval != 10*time.Second || reset {
+		t.Errorf("counterDiff without a reset = %#v, %v, %v, want 30, 10s, false", diff, interval, reset)
+	}
+}
+
+func TestSignedChange(t *testing.T) {
+	tests := []struct {
+		old, new interface{}
+		change   interface{}
+	}{
+		{int64(10), int64(4), int64(-6)},
+		{int64(4), int64(10), int64(6)},
+		{float64(1.5), float64(1), float64(-0.5)},
+		{uint64(10), int64(4), float64(-6)},
+		{int64(1), "a", "a"},
+	}
+
+	for _, test := range tests {
+		if change := signedChange(test.old, test.new); !reflect.DeepEqual(change, test.change) {
+			t.Errorf("signedChange(%v, %v) = %#v, want %#v", test.old, test.new, change, test.change)
+		}
+	}
+}
+
+func TestDeltaKey(t *testing.T) {
+	tests := []struct {
+		parts []string
+	}{
+		{[]string{"Com_select"}},
+		{[]string{"db1", "status"}},
+		{[]string{"ab", "c"}},
+		{[]string{"a", "bc"}},
+		{[]string{"a|b", "c"}},
+		{[]string{`quote"d`, `back\slash`}},
+		{[]string{"", ""}},
+	}
+
+	keys := map[string]bool{}
+	for _, test := range tests {
+		key := deltaKey(test.parts...)
+		if keys[key] {
+			t.Errorf("deltaKey(%q) = %s collides", test.parts, key)
+		}
+		keys[key] = true
+
+		if parts := splitDeltaKey(key); !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("splitDeltaKey(%s) = %q, want %q", key, parts, test.parts)
+		}
+	}
+
+	// NULL delta key values are not quoted
+	if parts := splitDeltaKey(`"a"|NULL|"b"`); !reflect.DeepEqual(parts, []string{"a", "NULL", "b"}) {
+		t.Errorf(`splitDeltaKey("a"|NULL|"b") = %q`, parts)
+	}
+}
+
+func TestDeltaStoreExpire(t *testing.T) {
+	s := newDeltaStore()
+	now := time.Now()
+
+	// Cycle 1: a and b of q1, c of q2; cycle 2: a of q1 only
+	s.swap("q1", 1, 0, "a", int64(1), now)
+	s.swap("q1", 1, 0, "b", int64(1), now)
+	s.swap("q2", 1, 0, "c", int64(1), now)
+	s.swap("q1", 2, 0, "a", int64(2), now)
+
+	if evicted, _ := s.expire("q1", 2, 1); evicted != 0 {
+		t.Errorf("expire within the ttl evicted %d keys, want 0", evicted)
+	}
+	if evicted, _ := s.expire("q1", 3, 1); evicted != 1 {
+		t.Errorf("expire evicted %d keys, want 1", evicted)
+	}
+	if _, ok := s.swap("q1", 3, 0, "b", int64(3), now); ok {
+		t.Errorf("evicted key b still has a value")
+	}
+	if old, ok := s.swap("q2", 3, 0, "c", int64(3), now); !ok || old.value != int64(1) {
+		t.Errorf("key c of another query = %v, %v, want 1, true", old.value, ok)
+	}
+
+	// maxkeys drops new keys but keeps updating the tracked ones
+	s.swap("q3", 1, 2, "a", int64(1), now)
+	s.swap("q3", 1, 2, "b", int64(1), now)
+	s.swap("q3", 1, 2, "c", int64(1), now)
+	s.swap("q3", 1, 2, "d", int64(1), now)
+	if _, ok := s.swap("q3", 2, 2, "a", int64(2), now); !ok {
+		t.Errorf("tracked key a was dropped")
+	}
+	if _, dropped := s.expire("q3", 2, 0); dropped != 2 {
+		t.Errorf("dropped %d keys, want 2", dropped)
+	}
+	if _, ok := s.swap("q3", 2, 2, "c", int64(2), now); ok {
+		t.Errorf("key c over maxkeys has a value")
+	}
+}
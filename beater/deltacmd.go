@@ -0,0 +1,70 @@
+package beater
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// deltaUsage is the usage of the delta subcommands
+const deltaUsage = "usage: mysqlbeat delta dump [-c mysqlbeat.yml] [-file delta state file] [-host name] [-query name]"
+
+// DeltaCommand runs a delta subcommand of mysqlbeat:
+//
+//	mysqlbeat delta dump [-c mysqlbeat.yml] [-file delta-state.db] [-host name] [-query name]
+//
+// dump prints the delta values of every host query as of the last checkpoint of the delta state file of the
+// configuration (-c). The current values of a running mysqlbeat are published as the mysqlbeat.delta.state expvar.
+func DeltaCommand(args []string) error {
+	if len(args) < 1 || args[0] != "dump" {
+		return errors.New(deltaUsage)
+	}
+
+	flags := flag.NewFlagSet("delta dump", flag.ContinueOnError)
+	configFile := flags.String("c", defaultConfigFile(), "configuration file")
+	path := flags.String("file", "", "delta state file (default: the delta state file of the configuration)")
+	hostName := flags.String("host", "", "only dump the values of this host")
+	queryName := flags.String("query", "", "only dump the values of this query")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *path == "" {
+		bt, err := newCommandBeat(*configFile)
+		if err != nil {
+			return err
+		}
+
+		*path = bt.deltaStatePath()
+		if *path == "" {
+			return fmt.Errorf("the delta state is disabled in %s, there is no checkpoint to dump", *configFile)
+		}
+	}
+
+	info, err := os.Stat(*path)
+	if err != nil {
+		return err
+	}
+
+	entries, invalid, err := readDeltaState(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Delta values of %s, checkpointed at %s\n", *path, info.ModTime().Format("2006-01-02T15:04:05Z07:00"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tQUERY\tKEY\tTYPE\tVALUE\tAGE")
+	for _, entry := range dumpDeltaEntries(entries, *hostName, *queryName) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.Host, entry.Query, entry.Key, entry.Type, entry.Value, entry.Age.Format("2006-01-02T15:04:05Z07:00"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if invalid > 0 {
+		fmt.Fprintf(os.Stderr, "%d invalid lines in %s\n", invalid, *path)
+	}
+	return nil
+}
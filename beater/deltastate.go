@@ -0,0 +1,236 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// Delta value types in the delta state file
+	deltaStateInt   = "int"
+	deltaStateUint  = "uint"
+	deltaStateFloat = "float"
+)
+
+// deltaStateEntry is a line of the delta state file, the value is saved as a string with its type
+type deltaStateEntry struct {
+	Owner string    `json:"owner,omitempty"`
+	Key   string    `json:"key"`
+	Type  string    `json:"type"`
+	Value string    `json:"value"`
+	Age   time.Time `json:"age"`
+}
+
+// deltaDumpEntry is a delta value of a host query, as dumped by mysqlbeat delta dump and the mysqlbeat.delta.state expvar
+type deltaDumpEntry struct {
+	Host  string    `json:"host"`
+	Query string    `json:"query"`
+	Key   string    `json:"key"`
+	Type  string    `json:"type"`
+	Value string    `json:"value"`
+	Age   time.Time `json:"age"`
+}
+
+var (
+	// runningDeltas is the delta store of the running beat, its current values are published as an expvar
+	runningDeltas struct {
+		sync.Mutex
+		store *deltaStore
+	}
+)
+
+func init() {
+	expvar.Publish("mysqlbeat.delta.state", expvar.Func(func() interface{} {
+		runningDeltas.Lock()
+		store := runningDeltas.store
+		runningDeltas.Unlock()
+
+		if store == nil {
+			return []deltaDumpEntry{}
+		}
+		return dumpDeltaEntries(store.entries(), "", "")
+	}))
+}
+
+// publishDeltaStore publishes the current values of the delta store as the mysqlbeat.delta.state expvar
+func publishDeltaStore(s *deltaStore) {
+	runningDeltas.Lock()
+	defer runningDeltas.Unlock()
+
+	runningDeltas.store = s
+}
+
+// dumpDeltaEntries returns the delta values by host query, sorted by host query and key (of a host or query only if set)
+func dumpDeltaEntries(entries []deltaStateEntry, hostName string, queryName string) []deltaDumpEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Owner != entries[j].Owner {
+			return entries[i].Owner < entries[j].Owner
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	dump := []deltaDumpEntry{}
+	for _, entry := range entries {
+		owner := splitDeltaKey(entry.Owner)
+		if len(owner) != 2 {
+			owner = []string{entry.Owner, ""}
+		}
+
+		if hostName != "" && owner[0] != hostName || queryName != "" && owner[1] != queryName {
+			continue
+		}
+
+		dump = append(dump, deltaDumpEntry{
+			Host:  owner[0],
+			Query: owner[1],
+			Key:   strings.TrimPrefix(entry.Key, entry.Owner+"|"),
+			Type:  entry.Type,
+			Value: entry.Value,
+			Age:   entry.Age,
+		})
+	}
+	return dump
+}
+
+// entries returns the numeric values of the store
+func (s *deltaStore) entries() []deltaStateEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entries []deltaStateEntry
+	for owner, values := range s.values {
+		for key, v := range values {
+			entry := deltaStateEntry{Owner: owner, Key: key, Age: v.age}
+			switch value := v.value.(type) {
+			case int64:
+				entry.Type, entry.Value = deltaStateInt, strconv.FormatInt(value, 10)
+			case uint64:
+				entry.Type, entry.Value = deltaStateUint, strconv.FormatUint(value, 10)
+			case float64:
+				entry.Type, entry.Value = deltaStateFloat, strconv.FormatFloat(value, 'g', -1, 64)
+			default:
+				// Only numbers have a delta
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// save checkpoints the numeric values of the store to a state file
+func (s *deltaStore) save(path string) error {
+	entries := s.entries()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, buf.Bytes(), false)
+}
+
+// load restores the values of a state file, values older than maxAge (when set) are discarded
+// so a stale checkpoint doesn't average the rates over a long downtime
+func (s *deltaStore) load(path string, maxAge time.Duration) error {
+	entries, invalid, err := readDeltaState(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loaded, expired := 0, 0
+	now := time.Now()
+
+	for _, entry := range entries {
+		if maxAge > 0 && now.Sub(entry.Age) > maxAge {
+			expired++
+			continue
+		}
+
+		value, err := entry.parse()
+		if err != nil {
+			invalid++
+			continue
+		}
+
+		// The delta cycles start again, the loaded keys expire as if they were seen before the first cycle
+		values, ok := s.values[entry.Owner]
+		if !ok {
+			values = map[string]deltaValue{}
+			s.values[entry.Owner] = values
+		}
+		values[entry.Key] = deltaValue{value: value, age: entry.Age}
+		loaded++
+	}
+
+	logp.Info("Loaded %d delta values from %s (%d expired, %d invalid)", loaded, path, expired, invalid)
+	return nil
+}
+
+// readDeltaState reads the entries of a state file and counts the lines that are not valid entries
+func readDeltaState(path string) ([]deltaStateEntry, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var entries []deltaStateEntry
+	invalid := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deltaStateEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Key == "" {
+			invalid++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, invalid, scanner.Err()
+}
+
+// parse returns the value of an entry with its type
+func (entry deltaStateEntry) parse() (interface{}, error) {
+	switch entry.Type {
+	case deltaStateInt:
+		return strconv.ParseInt(entry.Value, 10, 64)
+	case deltaStateUint:
+		return strconv.ParseUint(entry.Value, 10, 64)
+	case deltaStateFloat:
+		return strconv.ParseFloat(entry.Value, 64)
+	}
+	return nil, fmt.Errorf("unknown delta value type '%s'", entry.Type)
+}
+
+// saveDeltaState checkpoints the delta values, if the delta state is enabled
+func (bt *Mysqlbeat) saveDeltaState() {
+	if bt.deltaStateFile == "" {
+		return
+	}
+
+	if err := bt.deltas.save(bt.deltaStateFile); err != nil {
+		logp.Err("Cannot save the delta state to %s: %v", bt.deltaStateFile, err)
+	}
+}
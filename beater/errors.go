@@ -0,0 +1,85 @@
+package beater
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	// query error policies values
+	onErrorContinue = "continue"
+	onErrorDisable  = "disable"
+	onErrorFatal    = "fatal"
+
+	defaultMaxFailures = 3
+
+	// error events type value
+	eventTypeQueryError = "query-error"
+)
+
+var (
+	queryFailures = expvar.NewInt("mysqlbeat.query.failures")
+	queryDisabled = expvar.NewInt("mysqlbeat.query.disabled")
+)
+
+// handleQueryError applies the error policy of a failed query, it returns an error only if the beat must stop
+func (bt *Mysqlbeat) handleQueryError(b *beat.Beat, h *host, q *query, err error) error {
+	q.mu.Lock()
+	q.failures++
+	failures := q.failures
+	disable := q.onError == onErrorDisable && !q.disabled && failures >= q.maxFailures
+	if disable {
+		q.disabled = true
+	}
+	q.mu.Unlock()
+
+	queryFailures.Add(1)
+
+	logp.Err("Host %v query %v failed (%d consecutive failures): %v", h.name, q.name, failures, err)
+
+	if q.errorEvents {
+		b.Events.PublishEvent(newErrorEvent(h, q, failures, err))
+	}
+
+	if q.onError == onErrorFatal {
+		return fmt.Errorf("host %v query %v failed: %v", h.name, q.name, err)
+	}
+
+	if disable {
+		queryDisabled.Add(1)
+		logp.Err("Host %v query %v disabled after %d consecutive failures", h.name, q.name, failures)
+	}
+
+	// The query is retried on its next period
+	return nil
+}
+
+// newErrorEvent creates an event describing the failure of a query
+func newErrorEvent(h *host, q *query, failures int, err error) common.MapStr {
+	errorInfo := common.MapStr{
+		"message":  err.Error(),
+		"failures": failures,
+	}
+
+	switch queryErr := err.(type) {
+	case *mysql.MySQLError:
+		errorInfo["code"] = queryErr.Number
+		errorInfo["message"] = queryErr.Message
+	case *queryTimeoutError:
+		errorInfo["timeout"] = true
+	}
+
+	return common.MapStr{
+		"@timestamp": common.Time(time.Now()),
+		"type":       eventTypeQueryError,
+		"query":      q.name,
+		"host":       h.name,
+		"error":      errorInfo,
+	}
+}
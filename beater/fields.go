@@ -0,0 +1,150 @@
+package beater
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+const (
+	// Delta field namings, flat fields (COM_SELECT_PERSECOND) or nested fields (COM_SELECT.rate)
+	namingFlat   = "flat"
+	namingNested = "nested"
+
+	// Delta fields besides the delta modes
+	deltaFieldRaw      = "raw"
+	deltaFieldInterval = "interval"
+
+	// namePlaceholder is replaced by the column name in the delta field templates
+	namePlaceholder = "{name}"
+
+	// Field name cases, the column names are kept as is, lowercased or snake_cased
+	fieldCaseNone  = "none"
+	fieldCaseLower = "lower"
+	fieldCaseSnake = "snake"
+)
+
+var (
+	// deltaFieldTemplates are the delta field names of every naming, a dot nests the field
+	deltaFieldTemplates = map[string]map[string]string{
+		namingFlat: {
+			deltaModeRate:      namePlaceholder + deltaModeSuffixes[deltaModeRate],
+			deltaModePerMinute: namePlaceholder + deltaModeSuffixes[deltaModePerMinute],
+			deltaModeDiff:      namePlaceholder + deltaModeSuffixes[deltaModeDiff],
+			deltaModeChange:    namePlaceholder + deltaModeSuffixes[deltaModeChange],
+			deltaFieldRaw:      namePlaceholder,
+			deltaFieldInterval: namePlaceholder + "_INTERVAL",
+		},
+		namingNested: {
+			deltaModeRate:      namePlaceholder + ".rate",
+			deltaModePerMinute: namePlaceholder + ".rate_per_minute",
+			deltaModeDiff:      namePlaceholder + ".diff",
+			deltaModeChange:    namePlaceholder + ".change",
+			deltaFieldRaw:      namePlaceholder + ".total",
+			deltaFieldInterval: namePlaceholder + ".interval",
+		},
+	}
+)
+
+// newDeltaFieldTemplates returns the delta field templates of a naming with the configured templates applied
+func newDeltaFieldTemplates(naming string, fields map[string]string) (map[string]string, error) {
+	if naming == "" {
+		naming = namingFlat
+	}
+
+	defaults, ok := deltaFieldTemplates[naming]
+	if !ok {
+		return nil, fmt.Errorf("unknown delta naming '%s'", naming)
+	}
+
+	templates := map[string]string{}
+	for field, template := range defaults {
+		templates[field] = template
+	}
+
+	for field, template := range fields {
+		if _, ok := templates[field]; !ok {
+			return nil, fmt.Errorf("unknown delta field '%s'", field)
+		}
+		if template == "" {
+			return nil, fmt.Errorf("delta field '%s' has an empty name", field)
+		}
+		templates[field] = template
+	}
+
+	return templates, nil
+}
+
+// fieldName returns the event field name of a column according to the field case of the query
+func (q *query) fieldName(name string) string {
+	switch q.fieldCase {
+	case fieldCaseLower:
+		return strings.ToLower(name)
+	case fieldCaseSnake:
+		return toSnakeCase(name)
+	}
+	return name
+}
+
+// deltaFieldName returns the event field name of a delta field (a delta mode, raw or interval) of a column
+func (q *query) deltaFieldName(field string, name string) string {
+	return strings.Replace(q.deltaFields[field], namePlaceholder, name, -1)
+}
+
+// toSnakeCase lowercases a name and separates its words with underscores (e.g. updatedTime is updated_time)
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+	var snake []rune
+
+	for i, r := range runes {
+		if r == ' ' || r == '-' {
+			r = '_'
+		}
+
+		// A new word starts on an upper case letter after a lower case letter or a digit,
+		// or on the last upper case letter of an acronym (e.g. HTTPServer is http_server)
+		if unicode.IsUpper(r) && i > 0 && runes[i-1] != '_' {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower {
+				snake = append(snake, '_')
+			}
+		}
+
+		snake = append(snake, unicode.ToLower(r))
+	}
+
+	return string(snake)
+}
+
+// putField adds a field to an event, a dotted name is nested (e.g. com_select.rate). The name is kept as is
+// when a parent field already holds a value that is not an object.
+func putField(event common.MapStr, name string, value interface{}) {
+	if !strings.Contains(name, ".") {
+		event[name] = value
+		return
+	}
+
+	parts := strings.Split(name, ".")
+	current := event
+	for _, part := range parts[:len(parts)-1] {
+		child, exists := current[part]
+		if !exists {
+			nested := common.MapStr{}
+			current[part] = nested
+			current = nested
+			continue
+		}
+
+		nested, ok := child.(common.MapStr)
+		if !ok {
+			event[name] = value
+			return
+		}
+		current = nested
+	}
+
+	current[parts[len(parts)-1]] = value
+}
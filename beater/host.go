@@ -0,0 +1,234 @@
+package beater
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+
+	"mysqlbeat/config"
+)
+
+const (
+	// dialTimeout bounds the connection to a host, a blackholed host would block until the TCP connect timeout
+	dialTimeout = 5 * time.Second
+
+	// healthCheckTimeout bounds a health check, connecting included
+	healthCheckTimeout = 10 * time.Second
+)
+
+// host is a monitored MySQL server and the queries that run against it
+type host struct {
+	name     string
+	hostname string
+	port     string
+	username string
+	password string
+	queries  []*query
+
+	// db is the connection pool of the host, it lives as long as the beat
+	db *sql.DB
+	// healthy is false after a failed health check, until the host answers again
+	healthMu sync.Mutex
+	healthy  bool
+	// countersReset is the time the status counters were last reset (uptime reset detection only)
+	countersReset time.Time
+
+	// stateKey partitions the resume state of the host, empty for the legacy single host config
+	stateKey string
+
+	// location is the time zone the driver writes the time parameters in
+	location *time.Location
+}
+
+// newHost creates a host from its config, missing connection settings are taken from the global config
+func newHost(bt *Mysqlbeat, hostConfig config.HostConfig) (*host, error) {
+	globalConfig := bt.beatConfig.Mysqlbeat
+
+	h := &host{
+		name:     hostConfig.Name,
+		hostname: hostConfig.Hostname,
+		port:     hostConfig.Port,
+		username: hostConfig.Username,
+		location: bt.location,
+	}
+
+	if h.hostname == "" {
+		h.hostname = globalConfig.Hostname
+	}
+
+	if h.port == "" {
+		h.port = globalConfig.Port
+	}
+
+	if h.username == "" {
+		h.username = globalConfig.Username
+	}
+
+	if h.name == "" {
+		h.name = fmt.Sprintf("%v:%v", h.hostname, h.port)
+	}
+
+	var err error
+	if hostConfig.Password != "" {
+		h.password = hostConfig.Password
+	} else if hostConfig.EncryptedPassword != "" {
+		h.password, err = decryptPassword(hostConfig.EncryptedPassword)
+	} else {
+		h.password, err = bt.globalPassword()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("host %s: %v", h.name, err)
+	}
+
+	// Global queries run on every host, host queries with the same name override them
+	overrides := map[string]config.QueryConfig{}
+	for _, queryConfig := range hostConfig.Queries {
+		if queryConfig.Name != "" {
+			overrides[queryConfig.Name] = queryConfig
+		}
+	}
+
+	queryConfigs := []config.QueryConfig{}
+	legacyTypes := []string{}
+	for index, queryConfig := range globalConfig.Queries {
+		var legacyType string
+		if index < len(globalConfig.QueryTypes) {
+			legacyType = globalConfig.QueryTypes[index]
+		}
+
+		if queryConfig.Name == "" {
+			queryConfig.Name = fmt.Sprintf("query_%d", index+1)
+		}
+
+		if override, ok := overrides[queryConfig.Name]; ok {
+			queryConfig = queryConfig.Merge(override)
+			delete(overrides, queryConfig.Name)
+		}
+
+		queryConfigs = append(queryConfigs, queryConfig)
+		legacyTypes = append(legacyTypes, legacyType)
+	}
+
+	for _, queryConfig := range hostConfig.Queries {
+		if _, ok := overrides[queryConfig.Name]; ok || queryConfig.Name == "" {
+			queryConfigs = append(queryConfigs, queryConfig)
+			legacyTypes = append(legacyTypes, "")
+		}
+	}
+
+	// Build the queries, legacy plain string queries take their type from the querytypes array
+	names := map[string]bool{}
+	for index, queryConfig := range queryConfigs {
+		if !queryConfig.IsEnabled() {
+			logp.Info("Host %s query #%d (%s) is disabled", h.name, index+1, queryConfig.Name)
+			continue
+		}
+
+		q, err := newQuery(bt, index, queryConfig, legacyTypes[index])
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %v", h.name, err)
+		}
+
+		if names[q.name] {
+			return nil, fmt.Errorf("host %s: query name %s is used more than once", h.name, q.name)
+		}
+		names[q.name] = true
+
+		h.queries = append(h.queries, q)
+		logp.Info("Host %s query %s (type: %s, schedule: %v): %s", h.name, q.name, q.queryType, q.schedule, q.sql)
+	}
+
+	return h, nil
+}
+
+// open creates the connection pool of the host, connections are only made when needed
+func (h *host) open(maxOpenConns int, maxIdleConns int, connMaxLifetime time.Duration) error {
+	db, err := sql.Open("mysql", h.dsn())
+	if err != nil {
+		return fmt.Errorf("host %s: %v", h.name, err)
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(connMaxLifetime)
+
+	h.db = db
+	h.healthy = true
+	return nil
+}
+
+// ping checks that the host answers within healthCheckTimeout, the pool reconnects by itself once the server is back
+func (h *host) ping() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	err := h.db.PingContext(ctx)
+
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+
+	if err != nil {
+		if h.healthy {
+			logp.Err("Host %s health check failed, skipping its queries until it's back: %v", h.name, err)
+		}
+		h.healthy = false
+		return false
+	}
+
+	if !h.healthy {
+		logp.Info("Host %s is back", h.name)
+	}
+	h.healthy = true
+	return true
+}
+
+// isHealthy returns the result of the last health check
+func (h *host) isHealthy() bool {
+	h.healthMu.Lock()
+	defer h.healthMu.Unlock()
+	return h.healthy
+}
+
+// close closes the connection pool of the host
+func (h *host) close() {
+	if h.db != nil {
+		h.db.Close()
+	}
+}
+
+// dsn returns the MySQL connection string of the host
+func (h *host) dsn() string {
+	return fmt.Sprintf("%v:%v@tcp(%v:%v)/?loc=%v&timeout=%v", h.username, h.password, h.hostname, h.port,
+		url.QueryEscape(h.location.String()), dialTimeout)
+}
+
+// globalPassword returns the password of the global config, decrypting it if needed
+func (bt *Mysqlbeat) globalPassword() (string, error) {
+	if bt.beatConfig.Mysqlbeat.Password != "" {
+		return bt.beatConfig.Mysqlbeat.Password, nil
+	}
+	return decryptPassword(bt.beatConfig.Mysqlbeat.EncryptedPassword)
+}
+
+// decryptPassword decrypts an AES encrypted password (see github.com/adibendahan/mysqlbeat-password-encrypter)
+func decryptPassword(encryptedPassword string) (string, error) {
+	aesCipher, err := aes.NewCipher([]byte(secret))
+	if err != nil {
+		return "", err
+	}
+	cfbDecrypter := cipher.NewCFBDecrypter(aesCipher, commonIV)
+	chiperText, err := hex.DecodeString(encryptedPassword)
+	if err != nil {
+		return "", err
+	}
+	plaintextCopy := make([]byte, len(chiperText))
+	cfbDecrypter.XORKeyStream(plaintextCopy, chiperText)
+	return string(plaintextCopy), nil
+}
@@ -1,56 +1,57 @@
 package beater
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"database/sql"
-	"encoding/hex"
 	"fmt"
 	"math"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/cfgfile"
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/publisher"
 
 	"mysqlbeat/config"
 
 	// mysql go driver
-	"bufio"
-	"encoding/json"
 	_ "github.com/go-sql-driver/mysql"
-	"os"
-	"regexp"
-	"sync"
 )
 
 // Mysqlbeat is a struct to hold the beat config & info
 type Mysqlbeat struct {
-	beatConfig       *config.Config
-	resumeFile       chan string
-	mu               sync.Mutex
-	done             chan struct{}
-	period           time.Duration
-	hostname         string
-	port             string
-	username         string
-	password         string
-	passwordAES      string
-	queries          []string
-	queryTypes       []string
-	deltaWildcard    string
-	deltaKeyWildcard string
-
-	oldValues    common.MapStr
-	oldValuesAge common.MapStr
-}
+	beatConfig *config.Config
+	done       chan struct{}
+	period     time.Duration
+	hosts      []*host
+
+	// fatal receives the error of a query that must stop the beat
+	fatal chan error
+
+	// stopping is closed once Run returns, whether the beat was stopped or a query failed fatally,
+	// the running queries give up waiting for a worker or the output then
+	stopping chan struct{}
+
+	// workers bounds the number of queries running at the same time
+	workers chan struct{}
 
-type ResumeIndex struct {
-	Index string `json:"index"`
-	Value string `json:"value"`
+	// deltas holds the old values of the delta columns
+	deltas *deltaStore
+
+	// resume holds the resume values of the resume-multiple-rows queries
+	resume *resumeStore
+
+	// deltaStateFile checkpoints the deltas every deltaCheckpoint, empty when the delta state is disabled
+	deltaStateFile  string
+	deltaCheckpoint time.Duration
+
+	// locks are the lock files of the state files, released on cleanup
+	locks []*stateLock
+
+	// location is the time zone of the date and time values
+	location *time.Location
 }
 
 var (
@@ -72,6 +73,12 @@ const (
 	defaultPassword         = "mysqlbeat_pass"
 	defaultDeltaWildcard    = "__DELTA"
 	defaultDeltaKeyWildcard = "__DELTAKEY"
+	defaultMaxIdleConns     = 2
+	defaultConcurrency      = 4
+	defaultDeltaStateFile   = "delta-state.db"
+	defaultDeltaStateMaxAge = "10m"
+	defaultDeltaKeyTTL      = 10
+	defaultTimeZone         = "Local"
 
 	// query types values
 	queryTypeSingleRow          = "single-row"
@@ -85,17 +92,16 @@ const (
 	// special column names values
 	columnNameSlaveDelay = "Seconds_Behind_Master"
 
-	// column types values
-	columnTypeString = iota
-	columnTypeInt
-	columnTypeFloat
+	// special event fields names values
+	fieldReplicationStopped = "replication_stopped"
 )
 
 // New Creates beater
 func New() *Mysqlbeat {
 	return &Mysqlbeat{
-		done:       make(chan struct{}),
-		resumeFile: make(chan string),
+		done:     make(chan struct{}),
+		fatal:    make(chan error, 1),
+		stopping: make(chan struct{}),
 	}
 }
 
@@ -120,16 +126,132 @@ func (bt *Mysqlbeat) Config(b *beat.Beat) error {
 // Setup is a function to setup all beat config & info into the beat struct
 func (bt *Mysqlbeat) Setup(b *beat.Beat) error {
 
-	if len(bt.beatConfig.Mysqlbeat.Queries) < 1 {
+	hostQueries := 0
+	for _, hostConfig := range bt.beatConfig.Mysqlbeat.Hosts {
+		hostQueries += len(hostConfig.Queries)
+	}
+
+	if len(bt.beatConfig.Mysqlbeat.Queries) < 1 && hostQueries < 1 {
 		err := fmt.Errorf("there are no queries to execute")
 		return err
 	}
 
-	if len(bt.beatConfig.Mysqlbeat.Queries) != len(bt.beatConfig.Mysqlbeat.QueryTypes) {
-		err := fmt.Errorf("error on config file, queries array length != queryTypes array length (each query should have a corresponding type on the same index)")
+	if err := bt.setupDefaults(); err != nil {
+		return err
+	}
+
+	// init the delta values store, its current values are published as the mysqlbeat.delta.state expvar
+	bt.deltas = newDeltaStore()
+	publishDeltaStore(bt.deltas)
+
+	// Load the delta values saved by the previous run
+	deltaState := bt.beatConfig.Mysqlbeat.DeltaState
+	if deltaStateFile := bt.deltaStatePath(); deltaStateFile != "" {
+		deltaState.File = deltaStateFile
+
+		if deltaState.MaxAge == "" {
+			deltaState.MaxAge = defaultDeltaStateMaxAge
+		}
+
+		maxAge, err := time.ParseDuration(deltaState.MaxAge)
+		if err != nil {
+			return err
+		}
+
+		bt.deltaCheckpoint = bt.period
+		if deltaState.Checkpoint != "" {
+			bt.deltaCheckpoint, err = time.ParseDuration(deltaState.Checkpoint)
+			if err != nil {
+				return err
+			}
+		}
+		if bt.deltaCheckpoint <= 0 {
+			return fmt.Errorf("the delta state checkpoint must be positive")
+		}
+
+		lock, err := lockStateFile(deltaState.File)
+		if err != nil {
+			return err
+		}
+		bt.locks = append(bt.locks, lock)
+
+		bt.deltaStateFile = deltaState.File
+		if err := bt.deltas.load(bt.deltaStateFile, maxAge); err != nil {
+			logp.Warn("Cannot load the delta state from %s, starting without it: %v", bt.deltaStateFile, err)
+		}
+	}
+
+	// Parse the connection pool settings
+	if bt.beatConfig.Mysqlbeat.MaxIdleConns == 0 {
+		logp.Info("MaxIdleConns not selected, proceeding with '%v' as default", defaultMaxIdleConns)
+		bt.beatConfig.Mysqlbeat.MaxIdleConns = defaultMaxIdleConns
+	}
+
+	var connMaxLifetime time.Duration
+	if bt.beatConfig.Mysqlbeat.ConnMaxLifetime != "" {
+		var err error
+		connMaxLifetime, err = time.ParseDuration(bt.beatConfig.Mysqlbeat.ConnMaxLifetime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bt.beatConfig.Mysqlbeat.Concurrency < 1 {
+		logp.Info("Concurrency not selected, proceeding with '%v' as default", defaultConcurrency)
+		bt.beatConfig.Mysqlbeat.Concurrency = defaultConcurrency
+	}
+	bt.workers = make(chan struct{}, bt.beatConfig.Mysqlbeat.Concurrency)
+
+	hosts, err := bt.newHosts()
+	if err != nil {
+		return err
+	}
+
+	// Load the resume values of the resume-multiple-rows queries, an instance owns its resume file
+	if hasResumeQueries(hosts) {
+		resumeFile := bt.resumeFile()
+		lock, err := lockStateFile(resumeFile)
+		if err != nil {
+			return err
+		}
+		bt.locks = append(bt.locks, lock)
+
+		// The resume values of the legacy resume file in the current directory move to a new resume file
+		if err := migrateResumeFile(resumeMultipleRowsFile, resumeFile); err != nil {
+			return err
+		}
+
+		bt.resume, err = newResumeStore(resumeFile)
+		if err != nil {
+			return err
+		}
+		logp.Info("Resume values are saved to %s", resumeFile)
+	}
+
+	totalQueries := 0
+	for _, h := range hosts {
+		err = h.open(bt.beatConfig.Mysqlbeat.MaxOpenConns, bt.beatConfig.Mysqlbeat.MaxIdleConns, connMaxLifetime)
+		if err != nil {
+			return err
+		}
+
+		bt.hosts = append(bt.hosts, h)
+		totalQueries += len(h.queries)
+	}
+
+	if totalQueries < 1 {
+		err := fmt.Errorf("there are no enabled queries to execute")
 		return err
 	}
 
+	logp.Info("Total # of hosts to monitor: %d", len(bt.hosts))
+	logp.Info("Total # of queries to execute: %d", totalQueries)
+
+	return nil
+}
+
+// setupDefaults sets the defaults of the missing global config and parses the period
+func (bt *Mysqlbeat) setupDefaults() error {
 	// Setting defaults for missing config
 	if bt.beatConfig.Mysqlbeat.Period == "" {
 		logp.Info("Period not selected, proceeding with '%v' as default", defaultPeriod)
@@ -156,105 +278,175 @@ func (bt *Mysqlbeat) Setup(b *beat.Beat) error {
 		bt.beatConfig.Mysqlbeat.Password = defaultPassword
 	}
 
-	if bt.beatConfig.Mysqlbeat.DeltaWildcard == "" {
+	// The legacy deltawildcard and deltakeywildcard are the global delta settings
+	if bt.beatConfig.Mysqlbeat.Delta.Wildcard == "" {
+		bt.beatConfig.Mysqlbeat.Delta.Wildcard = bt.beatConfig.Mysqlbeat.DeltaWildcard
+	}
+
+	if bt.beatConfig.Mysqlbeat.Delta.KeyWildcard == "" {
+		bt.beatConfig.Mysqlbeat.Delta.KeyWildcard = bt.beatConfig.Mysqlbeat.DeltaKeyWildcard
+	}
+
+	if bt.beatConfig.Mysqlbeat.Delta.Wildcard == "" {
 		logp.Info("DeltaWildcard not selected, proceeding with '%v' as default", defaultDeltaWildcard)
-		bt.beatConfig.Mysqlbeat.DeltaWildcard = defaultDeltaWildcard
+		bt.beatConfig.Mysqlbeat.Delta.Wildcard = defaultDeltaWildcard
 	}
 
-	if bt.beatConfig.Mysqlbeat.DeltaKeyWildcard == "" {
+	if bt.beatConfig.Mysqlbeat.Delta.KeyWildcard == "" {
 		logp.Info("DeltaKeyWildcard not selected, proceeding with '%v' as default", defaultDeltaKeyWildcard)
-		bt.beatConfig.Mysqlbeat.DeltaKeyWildcard = defaultDeltaKeyWildcard
+		bt.beatConfig.Mysqlbeat.Delta.KeyWildcard = defaultDeltaKeyWildcard
 	}
 
 	// Parse the Period string
-	var durationParseError error
-	bt.period, durationParseError = time.ParseDuration(bt.beatConfig.Mysqlbeat.Period)
-	if durationParseError != nil {
-		return durationParseError
+	var err error
+	bt.period, err = time.ParseDuration(bt.beatConfig.Mysqlbeat.Period)
+	if err != nil {
+		return err
 	}
 
-	// Handle password decryption and save in the bt
-	if bt.beatConfig.Mysqlbeat.Password != "" {
-		bt.password = bt.beatConfig.Mysqlbeat.Password
-	} else if bt.beatConfig.Mysqlbeat.EncryptedPassword != "" {
-		aesCipher, err := aes.NewCipher([]byte(secret))
-		if err != nil {
-			return err
-		}
-		cfbDecrypter := cipher.NewCFBDecrypter(aesCipher, commonIV)
-		chiperText, err := hex.DecodeString(bt.beatConfig.Mysqlbeat.EncryptedPassword)
-		if err != nil {
-			return err
-		}
-		plaintextCopy := make([]byte, len(chiperText))
-		cfbDecrypter.XORKeyStream(plaintextCopy, chiperText)
-		bt.password = string(plaintextCopy)
+	// The state files are in the data directory next to the binary by default
+	if bt.beatConfig.Mysqlbeat.DataPath == "" {
+		bt.beatConfig.Mysqlbeat.DataPath = defaultDataPath()
 	}
 
-	// init the oldValues and oldValuesAge array
-	bt.oldValues = common.MapStr{"mysqlbeat": "init"}
-	bt.oldValuesAge = common.MapStr{"mysqlbeat": "init"}
+	// The date and time values are read and bound in a single time zone
+	if bt.beatConfig.Mysqlbeat.TimeZone == "" {
+		bt.beatConfig.Mysqlbeat.TimeZone = defaultTimeZone
+	}
+	bt.location, err = time.LoadLocation(bt.beatConfig.Mysqlbeat.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone '%s': %v", bt.beatConfig.Mysqlbeat.TimeZone, err)
+	}
+	return nil
+}
 
-	// Save config values to the bt
-	bt.hostname = bt.beatConfig.Mysqlbeat.Hostname
-	bt.port = bt.beatConfig.Mysqlbeat.Port
-	bt.username = bt.beatConfig.Mysqlbeat.Username
-	bt.queries = bt.beatConfig.Mysqlbeat.Queries
-	bt.queryTypes = bt.beatConfig.Mysqlbeat.QueryTypes
-	bt.deltaWildcard = bt.beatConfig.Mysqlbeat.DeltaWildcard
-	bt.deltaKeyWildcard = bt.beatConfig.Mysqlbeat.DeltaKeyWildcard
+// newHosts builds the hosts and their queries without connecting to them, hosts without enabled queries are skipped
+func (bt *Mysqlbeat) newHosts() ([]*host, error) {
+	// Without a hosts array, the global connection settings define a single host
+	hostConfigs := bt.beatConfig.Mysqlbeat.Hosts
+	legacyHost := len(hostConfigs) == 0
+	if legacyHost {
+		hostConfigs = []config.HostConfig{{}}
+	}
 
-	safeQueries := true
+	var hosts []*host
+	names := map[string]bool{}
+	for _, hostConfig := range hostConfigs {
+		h, err := newHost(bt, hostConfig)
+		if err != nil {
+			return nil, err
+		}
 
-	logp.Info("Total # of queries to execute: %d", len(bt.queries))
-	for index, queryStr := range bt.beatConfig.Mysqlbeat.Queries {
+		if names[h.name] {
+			return nil, fmt.Errorf("host name %s is used more than once", h.name)
+		}
+		names[h.name] = true
 
-		strCleanQuery := strings.TrimSpace(strings.ToUpper(queryStr))
+		if len(h.queries) < 1 {
+			logp.Warn("Host %s has no enabled queries to execute", h.name)
+			continue
+		}
 
-		if !strings.HasPrefix(strCleanQuery, "SELECT") && !strings.HasPrefix(strCleanQuery, "SHOW") || strings.ContainsAny(strCleanQuery, ";") {
-			safeQueries = false
+		if !legacyHost {
+			h.stateKey = h.name
 		}
 
-		logp.Info("Query #%d (type: %s): %s", index+1, bt.queryTypes[index], queryStr)
+		hosts = append(hosts, h)
 	}
 
-	if !safeQueries {
-		err := fmt.Errorf("Only SELECT/SHOW queries are allowed (the char ; is forbidden)")
-		return err
+	return hosts, nil
+}
+
+// deltaStatePath returns the path of the delta state file, empty when the delta state is disabled
+func (bt *Mysqlbeat) deltaStatePath() string {
+	deltaState := bt.beatConfig.Mysqlbeat.DeltaState
+	if deltaState.Enabled != nil && !*deltaState.Enabled {
+		return ""
 	}
 
-	return nil
+	file := deltaState.File
+	if file == "" {
+		file = defaultDeltaStateFile
+	}
+	return statePath(bt.beatConfig.Mysqlbeat.DataPath, file)
+}
+
+// hasResumeQueries returns true if a host runs a resume-multiple-rows query, only then a resume file is needed
+func hasResumeQueries(hosts []*host) bool {
+	for _, h := range hosts {
+		for _, q := range h.queries {
+			if q.queryType == queryTypeResumeMultipleRows {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resumeFile returns the path of the resume file
+func (bt *Mysqlbeat) resumeFile() string {
+	resumeFile := bt.beatConfig.Mysqlbeat.ResumeFile
+	if resumeFile == "" {
+		resumeFile = resumeMultipleRowsFile
+	}
+	return statePath(bt.beatConfig.Mysqlbeat.DataPath, resumeFile)
 }
 
 // Run is a functions that runs the beat
 func (bt *Mysqlbeat) Run(b *beat.Beat) error {
 	logp.Info("mysqlbeat is running! Hit CTRL-C to stop it.")
 
-	file, err := os.OpenFile(resumeMultipleRowsFile, os.O_CREATE, 0666)
-	if err != nil {
-		logp.Err("cannot open file %s", resumeMultipleRowsFile)
+	// The hosts are health checked all at once before their queries first run, a dead host only delays
+	// the start by the health check timeout
+	var wg sync.WaitGroup
+	for _, h := range bt.hosts {
+		wg.Add(1)
+		go func(h *host) {
+			defer wg.Done()
+			h.ping()
+		}(h)
 	}
-	file.Close()
+	wg.Wait()
 
-	ticker := time.NewTicker(bt.period)
+	// Every query of every host runs on its own period, hosts are health checked on the beat period
+	sched := newScheduler()
+	for _, h := range bt.hosts {
+		h := h
+		sched.add(fmt.Sprintf("%v health check", h.name), periodicSchedule{bt.period}, overlapSkip, func() { h.ping() })
 
-	go bt.listenResumeFile()
-
-	for {
-		select {
-		case <-bt.done:
-			return nil
-		case <-ticker.C:
-			err := bt.beat(b)
-			if err != nil {
-				return err
-			}
+		for _, q := range h.queries {
+			q := q
+			sched.add(fmt.Sprintf("%v/%v", h.name, q.name), q.schedule, q.overlap, func() { bt.beat(b, h, q) })
 		}
 	}
+
+	// The delta values are checkpointed periodically and once all the queries are stopped
+	if bt.deltaStateFile != "" {
+		sched.add("delta state checkpoint", periodicSchedule{bt.deltaCheckpoint}, overlapSkip, bt.saveDeltaState)
+		defer bt.saveDeltaState()
+	}
+
+	// The scheduler waits for the running queries, they are told to give up first
+	sched.start()
+	defer sched.stop()
+	defer close(bt.stopping)
+
+	select {
+	case <-bt.done:
+		return nil
+	case err := <-bt.fatal:
+		return err
+	}
 }
 
-// Cleanup is a function that does nothing on this beat :)
+// Cleanup is a function that closes the connection pools of the hosts and releases the state files
 func (bt *Mysqlbeat) Cleanup(b *beat.Beat) error {
+	for _, h := range bt.hosts {
+		h.close()
+	}
+	for _, lock := range bt.locks {
+		lock.unlock()
+	}
 	return nil
 }
 
@@ -265,397 +457,479 @@ func (bt *Mysqlbeat) Stop() {
 
 ///*** mysqlbeat methods ***///
 
-// beat is a function that iterate over the query array, generate and publish events
-func (bt *Mysqlbeat) beat(b *beat.Beat) error {
+// beat is a function that runs a scheduled query of a host, generate and publish its events
+func (bt *Mysqlbeat) beat(b *beat.Beat, h *host, q *query) {
 
-	// Build the MySQL connection string
-	connString := fmt.Sprintf("%v:%v@tcp(%v:%v)/", bt.username, bt.password, bt.hostname, bt.port)
+	// Skip the query while it's disabled or its host doesn't answer
+	if q.isDisabled() || !h.isHealthy() {
+		return
+	}
 
-	db, err := sql.Open("mysql", connString)
+	// A failing query doesn't stop the other queries, unless its error policy is fatal
+	err := bt.runQuery(b, h, q)
 	if err != nil {
-		return err
+		// A run interrupted by the beat stopping isn't a failure of the query
+		select {
+		case <-bt.stopping:
+			logp.Info("Host %v query %v stopped: %v", h.name, q.name, err)
+			return
+		default:
+		}
+
+		err = bt.handleQueryError(b, h, q, err)
+		if err != nil {
+			select {
+			case bt.fatal <- err:
+			default:
+			}
+		}
+		return
 	}
-	defer db.Close()
 
-	// Create a two-columns event for later use
-	var twoColumnEvent common.MapStr
+	// Great success!
+	q.resetFailures()
+}
+
+// runQuery is a function that runs a query against a host, generate and publish its events.
+// A resume-multiple-rows query in catch-up mode runs page after page until it's caught up or its budget is exhausted.
+func (bt *Mysqlbeat) runQuery(b *beat.Beat, h *host, q *query) error {
+	if !q.catchUp {
+		_, err := bt.runOnce(b, h, q)
+		return err
+	}
 
-LoopQueries:
-	for index, queryStr := range bt.queries {
-		var lastResumeEvent common.MapStr
-		var uniKey string
-		var column string
+	start := time.Now()
+	total, pages := 0, 0
+	for {
+		before, _ := bt.resume.get(h.stateKey, q.resume.Index)
 
-		// Log the query run time and run the query
-		queryStr, uniKey, column = bt.query(index, queryStr)
-		dtNow := time.Now()
-		rows, err := db.Query(queryStr)
+		rowCount, err := bt.runOnce(b, h, q)
 		if err != nil {
 			return err
 		}
+		total += rowCount
+		pages++
 
-		// Populate columns array
-		columns, err := rows.Columns()
-		if err != nil {
-			return err
+		// A full page that doesn't move the cursor would be read again and again
+		if after, _ := bt.resume.get(h.stateKey, q.resume.Index); rowCount >= q.pageSize && after.Value == before.Value &&
+			strings.Join(after.Values, "\x00") == strings.Join(before.Values, "\x00") {
+			logp.Warn("Host %v query %v read a full page without moving its resume cursor", h.name, q.name)
+			return nil
 		}
 
-		// Populate the two-columns event
-		if bt.queryTypes[index] == queryTypeTwoColumns {
-			twoColumnEvent = common.MapStr{
-				"@timestamp": common.Time(dtNow),
-				"type":       queryTypeTwoColumns,
+		// A short page is the last one, the resume cursor reached the end of the table
+		if rowCount < q.pageSize {
+			if pages > 1 {
+				logp.Info("Host %v query %v caught up %d rows in %d pages", h.name, q.name, total, pages)
 			}
+			return nil
 		}
 
-	LoopRows:
-		for rows.Next() {
-
-			switch bt.queryTypes[index] {
-			case queryTypeSingleRow, queryTypeSlaveDelay:
-				// Generate an event from the current row
-				event, err := bt.generateEventFromRow(rows, columns, bt.queryTypes[index], dtNow)
+		if q.maxRows > 0 && total >= q.maxRows || q.maxTime > 0 && time.Since(start) >= q.maxTime {
+			logp.Info("Host %v query %v read %d rows in %d pages, it goes on with the next run", h.name, q.name, total, pages)
+			return nil
+		}
 
-				if err != nil {
-					logp.Err("Query #%v error generating event from rows: %v", index+1, err)
-				} else if event != nil {
-					b.Events.PublishEvent(event)
-					logp.Info("%v event sent", bt.queryTypes[index])
-				}
-				// breaking after the first row
-				break LoopRows
+		select {
+		case <-bt.stopping:
+			return nil
+		default:
+		}
+	}
+}
 
-			case queryTypeMultipleRows:
-				// Generate an event from the current row
-				event, err := bt.generateEventFromRow(rows, columns, bt.queryTypes[index], dtNow)
+// acquireWorker waits for a free worker, it returns false if the beat stops meanwhile
+func (bt *Mysqlbeat) acquireWorker() bool {
+	select {
+	case bt.workers <- struct{}{}:
+		return true
+	case <-bt.stopping:
+		return false
+	}
+}
 
-				if err != nil {
-					logp.Err("Query #%v error generating event from rows: %v", index+1, err)
-					break LoopRows
-				} else if event != nil {
-					b.Events.PublishEvent(event)
-					logp.Info("%v event sent", bt.queryTypes[index])
-				}
+// publishGuaranteed publishes events and waits until the output acknowledged them, which takes as long as
+// the output is down. It gives up when the beat stops, the publishing goroutine is then left to the shutdown.
+func (bt *Mysqlbeat) publishGuaranteed(b *beat.Beat, events []common.MapStr) error {
+	acked := make(chan bool, 1)
+	go func() {
+		acked <- b.Events.PublishEvents(events, publisher.Sync, publisher.Guaranteed)
+	}()
+
+	select {
+	case ok := <-acked:
+		if !ok {
+			return fmt.Errorf("%d events were not acknowledged by the output", len(events))
+		}
+		return nil
+	case <-bt.stopping:
+		return fmt.Errorf("the beat stopped before the output acknowledged %d events", len(events))
+	}
+}
 
-				// Move to the next row
-				continue LoopRows
+// runOnce runs a query (or a page of a resume-multiple-rows query) once and returns the number of rows it read
+func (bt *Mysqlbeat) runOnce(b *beat.Beat, h *host, q *query) (int, error) {
+	var resumeValues []string
 
-			case queryTypeResumeMultipleRows:
-				// Generate an event from the current row
-				event, err := bt.generateEventFromRow(rows, columns, bt.queryTypes[index], dtNow)
+	// rowCount is the number of rows read
+	rowCount := 0
 
-				if err != nil {
-					logp.Err("Query #%v error generating event from rows: %v", index+1, err)
-					break LoopRows
-				} else if event != nil {
-					b.Events.PublishEvent(event)
-					logp.Info("%v event sent", bt.queryTypes[index])
-				}
+	// The resume-multiple-rows events are published together, the resume value is saved once they are acknowledged
+	var resumeEvents []common.MapStr
 
-				lastResumeEvent = event
+	// Create a two-columns event for later use
+	var twoColumnEvent common.MapStr
 
-				// Move to the next row
-				continue LoopRows
+	// Wait for a free worker, the query holds it until its rows are read
+	if !bt.acquireWorker() {
+		return 0, nil
+	}
+	working := true
+	releaseWorker := func() {
+		if working {
+			working = false
+			<-bt.workers
+		}
+	}
+	defer releaseWorker()
 
-			case queryTypeTwoColumns:
-				// append current row to the two-columns event
-				err := bt.appendRowToEvent(twoColumnEvent, rows, columns, dtNow)
+	// The query is canceled (and killed on the server) after its timeout
+	ctx, cancel := q.context()
+	defer cancel()
 
-				if err != nil {
-					logp.Err("Query #%v error appending two-columns event: %v", index+1, err)
-					break LoopRows
-				}
-
-				// Move to the next row
-				continue LoopRows
-			}
-		}
+	conn, connectionID, err := h.conn(ctx, q.timeout > 0)
+	if err != nil {
+		return 0, h.queryError(ctx, q, connectionID, err)
+	}
+	defer conn.Close()
 
-		if lastResumeEvent != nil && uniKey != "" && column != "" {
-			resumeValue := fmt.Sprintf("%s|%s", uniKey, fmt.Sprintf("%v", lastResumeEvent[column]))
-			bt.resumeFile <- resumeValue
+	// The uptime reset detection needs the time the counters were last reset
+	if q.resetDetection == resetDetectionUptime {
+		if err := h.refreshCountersReset(ctx, conn); err != nil {
+			logp.Warn("Host %v query %v can't read the counters uptime: %v", h.name, q.name, err)
 		}
+	}
 
-		// If the two-columns event has data, publish it
-		if bt.queryTypes[index] == queryTypeTwoColumns && len(twoColumnEvent) > 2 {
-			b.Events.PublishEvent(twoColumnEvent)
-			logp.Info("%v event sent", queryTypeTwoColumns)
-			twoColumnEvent = nil
-		}
+	// Log the query run time and run the query
+	queryStr, args, err := bt.query(h, q)
+	if err != nil {
+		return 0, err
+	}
+	dtNow := time.Now()
+	rows, err := conn.QueryContext(ctx, queryStr, args...)
+	if err != nil {
+		return 0, h.queryError(ctx, q, connectionID, err)
+	}
 
+	// Populate columns array, the values are converted according to the columns types
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
 		rows.Close()
-		if err = rows.Err(); err != nil {
-			logp.Err("Query #%v error closing rows: %v", index+1, err)
-			continue LoopQueries
+		return 0, err
+	}
+	columns := newColumns(q, columnTypes)
+
+	// The resume cursor is the value of the resume columns in the last row
+	var resumeColumns []int
+	if q.queryType == queryTypeResumeMultipleRows {
+		for _, name := range q.resume.Columns {
+			resumeColumn := -1
+			for i, c := range columns {
+				if c.name == name {
+					resumeColumn = i
+				}
+			}
+			if resumeColumn < 0 {
+				rows.Close()
+				return 0, fmt.Errorf("resume column %s is not in the query result", name)
+			}
+			resumeColumns = append(resumeColumns, resumeColumn)
 		}
 	}
 
-	// Great success!
-	return nil
-}
-
-// appendRowToEvent appends the two-column event the current row data
-func (bt *Mysqlbeat) appendRowToEvent(event common.MapStr, row *sql.Rows, columns []string, rowAge time.Time) error {
+	// Populate the two-columns event
+	var twoColumnValues map[string]interface{}
+	if q.queryType == queryTypeTwoColumns {
+		twoColumnEvent = newEvent(h, q, dtNow)
+		twoColumnValues = map[string]interface{}{}
+	}
 
-	// Make a slice for the values
-	values := make([]sql.RawBytes, len(columns))
+LoopRows:
+	for rows.Next() {
 
-	// Copy the references into such a []interface{} for row.Scan
-	scanArgs := make([]interface{}, len(values))
-	for i := range values {
-		scanArgs[i] = &values[i]
-	}
+		values, err := scanRow(rows, len(columns))
+		if err != nil {
+			logp.Err("Host %v query %v error reading row: %v", h.name, q.name, err)
+			break LoopRows
+		}
+		rowCount++
 
-	// Get RawBytes from data
-	err := row.Scan(scanArgs...)
-	if err != nil {
-		return err
-	}
+		switch q.queryType {
+		case queryTypeSingleRow, queryTypeSlaveDelay:
+			// Generate an event from the current row
+			event, err := bt.generateEventFromRow(h, q, values, columns, dtNow)
 
-	// First column is the name, second is the value
-	strColName := string(values[0])
-	strColValue := string(values[1])
-	strColType := columnTypeString
-	strEventColName := strings.Replace(strColName, bt.deltaWildcard, "_PERSECOND", 1)
+			if err != nil {
+				logp.Err("Host %v query %v error generating event from rows: %v", h.name, q.name, err)
+			} else if event != nil {
+				b.Events.PublishEvent(event)
+				logp.Info("%v event sent", q.queryType)
+			}
+			// breaking after the first row
+			break LoopRows
 
-	// Try to parse the value to an int64
-	nColValue, err := strconv.ParseInt(strColValue, 0, 64)
-	if err == nil {
-		strColType = columnTypeInt
-	}
+		case queryTypeMultipleRows:
+			// Generate an event from the current row
+			event, err := bt.generateEventFromRow(h, q, values, columns, dtNow)
 
-	// Try to parse the value to a float64
-	fColValue, err := strconv.ParseFloat(strColValue, 64)
-	if err == nil {
-		// If it's not already an established int64, set type to float
-		if strColType == columnTypeString {
-			strColType = columnTypeFloat
-		}
-	}
+			if err != nil {
+				logp.Err("Host %v query %v error generating event from rows: %v", h.name, q.name, err)
+				break LoopRows
+			} else if event != nil {
+				b.Events.PublishEvent(event)
+				logp.Info("%v event sent", q.queryType)
+			}
 
-	// If the column name ends with the deltaWildcard
-	if strings.HasSuffix(strColName, bt.deltaWildcard) {
-		var exists bool
-		_, exists = bt.oldValues[strColName]
+			// Move to the next row
+			continue LoopRows
 
-		// If an older value doesn't exist
-		if !exists {
-			// Save the current value in the oldValues array
-			bt.oldValuesAge[strColName] = rowAge
+		case queryTypeResumeMultipleRows:
+			// Generate an event from the current row
+			event, err := bt.generateEventFromRow(h, q, values, columns, dtNow)
 
-			if strColType == columnTypeString {
-				bt.oldValues[strColName] = strColValue
-			} else if strColType == columnTypeInt {
-				bt.oldValues[strColName] = nColValue
-			} else if strColType == columnTypeFloat {
-				bt.oldValues[strColName] = fColValue
+			if err != nil {
+				logp.Err("Host %v query %v error generating event from rows: %v", h.name, q.name, err)
+				break LoopRows
+			} else if event != nil {
+				resumeEvents = append(resumeEvents, event)
 			}
-		} else {
-			// If found the old value's age
-			if dtOldAge, ok := bt.oldValuesAge[strColName].(time.Time); ok {
-				delta := rowAge.Sub(dtOldAge)
-
-				if strColType == columnTypeInt {
-					var calcVal int64
-
-					// Get old value
-					oldVal, _ := bt.oldValues[strColName].(int64)
-					if nColValue > oldVal {
-						// Calculate the delta
-						devResult := float64((nColValue - oldVal)) / float64(delta.Seconds())
-						// Round the calculated result back to an int64
-						calcVal = roundF2I(devResult, .5)
-					} else {
-						calcVal = 0
-					}
-
-					// Add the delta value to the event
-					event[strEventColName] = calcVal
-
-					// Save current values as old values
-					bt.oldValues[strColName] = nColValue
-					bt.oldValuesAge[strColName] = rowAge
-				} else if strColType == columnTypeFloat {
-					var calcVal float64
-
-					// Get old value
-					oldVal, _ := bt.oldValues[strColName].(float64)
-					if fColValue > oldVal {
-						// Calculate the delta
-						calcVal = (fColValue - oldVal) / float64(delta.Seconds())
-					} else {
-						calcVal = 0
-					}
-
-					// Add the delta value to the event
-					event[strEventColName] = calcVal
-
-					// Save current values as old values
-					bt.oldValues[strColName] = fColValue
-					bt.oldValuesAge[strColName] = rowAge
-				} else {
-					event[strEventColName] = strColValue
+
+			// A NULL value can't be a cursor
+			if event != nil {
+				if cursor := rowCursor(values, resumeColumns); cursor != nil {
+					resumeValues = cursor
 				}
 			}
-		}
-	} else {
-		// Not a delta column, add the value to the event as is
-		if strColType == columnTypeString {
-			event[strEventColName] = strColValue
-		} else if strColType == columnTypeInt {
-			event[strEventColName] = nColValue
-		} else if strColType == columnTypeFloat {
-			event[strEventColName] = fColValue
+
+			// Move to the next row
+			continue LoopRows
+
+		case queryTypeTwoColumns:
+			// append current row to the two-columns event
+			err := bt.appendRowToEvent(h, q, twoColumnEvent, twoColumnValues, values, columns, dtNow)
+
+			if err != nil {
+				logp.Err("Host %v query %v error appending two-columns event: %v", h.name, q.name, err)
+				break LoopRows
+			}
+
+			// Move to the next row
+			continue LoopRows
 		}
 	}
 
-	// Great success!
-	return nil
-}
+	rows.Close()
+	rowsErr := rows.Err()
+	if rowsErr != nil {
+		rowsErr = h.queryError(ctx, q, connectionID, rowsErr)
+	}
 
-func (bt *Mysqlbeat) readResumeIndex(index string, reCh chan string) {
-	file, err := os.OpenFile(resumeMultipleRowsFile, os.O_RDONLY, 0)
-	if err != nil {
-		reCh <- ""
-		return
+	// The other queries run while the output acknowledges the events
+	conn.Close()
+	releaseWorker()
+
+	// The rows read before an error are sent as well, their resume value is still valid
+	if len(resumeEvents) > 0 {
+		if err := bt.publishGuaranteed(b, resumeEvents); err != nil {
+			return rowCount, fmt.Errorf("%v, the resume value is kept", err)
+		}
+		logp.Info("%d %v events sent", len(resumeEvents), q.queryType)
 	}
-	reader := bufio.NewReader(file)
-	for {
-		inputString, readerError := reader.ReadString('\n')
-		if readerError != nil {
-			reCh <- ""
-			return
+
+	if resumeValues != nil {
+		// Written before the next run of the query, so its cursor always moves forward
+		resumeIndex := ResumeIndex{
+			Host:  h.stateKey,
+			Index: q.resume.Index,
+			Value: resumeValues[0],
 		}
-		var m ResumeIndex
-		err := json.Unmarshal([]byte(inputString), &m)
-		if err != nil {
-			reCh <- ""
-			return
+		if len(resumeValues) > 1 {
+			resumeIndex.Values = resumeValues
 		}
-		if m.Index == index {
-			reCh <- m.Value
-			return
+
+		err = bt.resume.set(resumeIndex)
+		if err != nil {
+			return rowCount, fmt.Errorf("cannot save the resume value: %v", err)
 		}
 	}
+
+	if rowsErr != nil {
+		return rowCount, rowsErr
+	}
+
+	// Add the ratios of the query to the two-columns event
+	if q.queryType == queryTypeTwoColumns && len(q.deltaRatios) > 0 {
+		bt.calculateRatios(h, q, twoColumnEvent, twoColumnValues, "", dtNow)
+	}
+
+	// If the two-columns event has data, publish it
+	if q.queryType == queryTypeTwoColumns && len(twoColumnEvent) > len(newEvent(h, q, dtNow)) {
+		b.Events.PublishEvent(twoColumnEvent)
+		logp.Info("%v event sent", queryTypeTwoColumns)
+	}
+
+	// The delta keys not seen for a while are evicted
+	bt.expireDeltas(h, q)
+
+	return rowCount, nil
 }
 
-func (bt *Mysqlbeat) query(index int, queryStr string) (string, string, string) {
-	if bt.queryTypes[index] != queryTypeResumeMultipleRows {
-		return queryStr, "", ""
+// appendRowToEvent appends the two-column event the current row data
+// rowValues collects the values by variable name for the ratios of the query
+func (bt *Mysqlbeat) appendRowToEvent(h *host, q *query, event common.MapStr, rowValues map[string]interface{}, values []sql.RawBytes, columns []*column, rowAge time.Time) error {
+
+	if len(values) < 2 {
+		return fmt.Errorf("query type two-columns requires two columns")
 	}
-	reCh := make(chan string)
 
-	re := regexp.MustCompile(`\{\w*\|\w*\|\w*\}`)
-	target := re.FindString(queryStr)
-	reOne := regexp.MustCompile(`\w*\|\w*\|\w*`)
-	oneString := reOne.FindString(target)
-	values := strings.Split(oneString, "|")
+	// First column is the name, second is the value
+	strColName := string(values[0])
+	field, isDelta := q.deltaColumn(strColName)
 
-	go bt.readResumeIndex(values[0], reCh)
-	replace := <-reCh
+	// The rows mix different variables, the value type is guessed unless the columns option names the variable
+	kind := columnKindAuto
+	if columnKind, ok := q.columnKinds[strColName]; ok {
+		kind = columnKind
+	}
 
-	if replace == "" {
-		return re.ReplaceAllString(queryStr, values[1]), values[0], values[2]
+	// NULL values follow the nulls policy of the query
+	var colValue interface{}
+	if values[1] == nil {
+		var ok bool
+		colValue, ok = q.nullValue(strColName, &column{kind: kind, precision: columns[1].precision, scale: columns[1].scale, location: q.location})
+		if !ok {
+			return nil
+		}
 	} else {
-		return re.ReplaceAllString(queryStr, replace), values[0], values[2]
+		colValue = convertValue(kind, values[1], columns[1].precision, columns[1].scale, q.location)
 	}
-}
-
-func (bt *Mysqlbeat) listenResumeFile() {
-	for {
-		resumeValue := <-bt.resumeFile
-		values := strings.Split(resumeValue, "|")
-		resumeIndex := &ResumeIndex{Index: values[0], Value: values[1]}
-		go bt.writeToResumeFile(resumeIndex)
+	rowValues[strColName] = colValue
+
+	// If the column is a delta column
+	if isDelta && colValue == nil {
+		// A NULL counter has no delta
+		q.putDelta(event, field, nil, deltaResult{}, true)
+	} else if isDelta {
+		// Delta values are saved per host and query, the variable name is the key
+		strKey := deltaKey(strColName)
+
+		// Add the delta value to the event
+		calcVal, ok := bt.calculateDelta(h, q, strKey, field.mode, colValue, rowAge)
+		q.putDelta(event, field, colValue, calcVal, ok)
+	} else {
+		// Not a delta column, add the value to the event as is
+		event[field.name] = colValue
 	}
+
+	// Great success!
+	return nil
 }
 
-func (bt *Mysqlbeat) writeToResumeFile(resumeIndex *ResumeIndex) {
-	bt.mu.Lock()
-	contents := []string{}
-	file, err := os.OpenFile(resumeMultipleRowsFile, os.O_CREATE|os.O_RDONLY, 0)
-	if err != nil {
-		logp.Err("while write to resumeFile open file err", err)
+// query returns the SQL of the query and its arguments, resume placeholders are bound to the saved resume value
+// of the host, cursor placeholders are replaced by the predicate of the saved resume cursor
+func (bt *Mysqlbeat) query(h *host, q *query) (string, []interface{}, error) {
+	if q.queryType != queryTypeResumeMultipleRows {
+		return q.sql, nil, nil
+	}
 
+	cursor := q.resume.Defaults
+	if len(cursor) == 0 && q.resume.Default != "" && len(q.resume.Columns) == 1 {
+		cursor = []string{q.resume.Default}
 	}
-	reader := bufio.NewReader(file)
-	for {
-		line, readErr := reader.ReadString('\n')
-		if line != "" {
-			contents = append(contents, line)
-		}
-		if readErr != nil {
-			break
+
+	resumeValue := q.resume.Default
+
+	// A saved cursor of other resume columns (the config changed) never restarts the query from its defaults
+	resumeIndex, ok := bt.resume.get(h.stateKey, q.resume.Index)
+	if ok && resumeIndex.Value != "" {
+		saved := resumeIndex.cursor()
+		if len(saved) != len(q.resume.Columns) {
+			return "", nil, fmt.Errorf("the saved resume index %s has %d values but the query has %d resume columns (%s), "+
+				"fix it with mysqlbeat resume set or reset", q.resume.Index, len(saved), len(q.resume.Columns), strings.Join(q.resume.Columns, ", "))
 		}
+		resumeValue = resumeIndex.Value
+		cursor = saved
 	}
-	file.Close()
 
-	file, err = os.OpenFile(resumeMultipleRowsFile, os.O_WRONLY|os.O_TRUNC|os.O_SYNC, 0666)
-	defer file.Close()
-	if err != nil {
-		logp.Err("while write to resumeFile open file err", err)
-		bt.mu.Unlock()
-	}
-	writer := bufio.NewWriter(file)
+	// Every placeholder is bound as a parameter, in the order of the placeholders
+	var args []interface{}
+	var err error
+	queryStr := queryPlaceholder.ReplaceAllStringFunc(q.sql, func(match string) string {
+		placeholder := strings.Trim(match, `'"`)
 
-	find := false
-	for i := 0; i < len(contents); i++ {
-		var m ResumeIndex
-		jsErr := json.Unmarshal([]byte(contents[i]), &m)
-		if jsErr != nil {
-			continue
+		if placeholder == "{cursor}" {
+			predicate, predicateArgs, predicateErr := cursorPredicate(q.resume.Columns, q.resumeTypes, cursor, q.location)
+			if predicateErr != nil && err == nil {
+				err = predicateErr
+			}
+			args = append(args, predicateArgs...)
+			return predicate
 		}
-		if m.Index == resumeIndex.Index {
-			find = true
-			m.Value = resumeIndex.Value
+
+		// {resume} and {index|default|column} are the value of the first resume column
+		value, resumeType := resumeValue, q.resumeTypes[0]
+		if column := resumeColumnPlaceholder.FindStringSubmatch(placeholder); column != nil {
+			i := q.resumeColumn(column[1])
+			value, resumeType = "", q.resumeTypes[i]
+			if len(cursor) == len(q.resume.Columns) {
+				value = cursor[i]
+			}
 		}
-		jsContent, jsMErr := json.Marshal(m)
-		if jsMErr != nil {
-			continue
+
+		arg, argErr := resumeArg(value, resumeType, q.location)
+		if argErr != nil && err == nil {
+			err = fmt.Errorf("placeholder %s: %v", placeholder, argErr)
 		}
-		contents[i] = string(jsContent)
-	}
-	if !find {
-		findContent, _ := json.Marshal(resumeIndex)
-		contents = append(contents, string(findContent))
-	}
-	for content := range contents {
-		writer.WriteString(fmt.Sprintf("%s\n", contents[content]))
+		args = append(args, arg)
+		return "?"
+	})
+
+	return queryStr, args, err
+}
+
+// rowCursor returns the values of the resume columns of a row, nil if one of them is NULL
+func rowCursor(values []sql.RawBytes, resumeColumns []int) []string {
+	cursor := make([]string, len(resumeColumns))
+	for i, column := range resumeColumns {
+		if values[column] == nil {
+			return nil
+		}
+		cursor[i] = string(values[column])
 	}
-	writer.Flush()
-	bt.mu.Unlock()
+	return cursor
 }
 
 // generateEventFromRow creates a new event from the row data and returns it
-func (bt *Mysqlbeat) generateEventFromRow(row *sql.Rows, columns []string, queryType string, rowAge time.Time) (common.MapStr, error) {
-
-	// Make a slice for the values
-	values := make([]sql.RawBytes, len(columns))
-
-	// Copy the references into such a []interface{} for row.Scan
-	scanArgs := make([]interface{}, len(values))
-	for i := range values {
-		scanArgs[i] = &values[i]
-	}
+func (bt *Mysqlbeat) generateEventFromRow(h *host, q *query, values []sql.RawBytes, columns []*column, rowAge time.Time) (common.MapStr, error) {
 
 	// Create the event and populate it
-	event := common.MapStr{
-		"@timestamp": common.Time(rowAge),
-		"type":       queryType,
+	queryType := q.queryType
+	event := newEvent(h, q, rowAge)
+	emptyEventLen := len(event)
+
+	// The key of the row, multiple rows are told apart by their delta key columns
+	var rowKey string
+	if queryType == queryTypeMultipleRows {
+		rowKey, _ = getKeyFromRow(q, values, columns)
 	}
 
-	// Get RawBytes from data
-	err := row.Scan(scanArgs...)
-	if err != nil {
-		return nil, err
-	}
+	// The values by column name, for the ratios of the query
+	rowValues := map[string]interface{}{}
 
 	// Loop on all columns
 	for i, col := range values {
-		// Get column name and string value
-		strColName := string(columns[i])
-		strColValue := string(col)
-		strColType := columnTypeString
+		// Get column name
+		strColName := columns[i].name
 
 		// Skip column proccessing when query type is show-slave-delay and the column isn't Seconds_Behind_Master
 		if queryType == queryTypeSlaveDelay && strColName != columnNameSlaveDelay {
@@ -663,151 +937,141 @@ func (bt *Mysqlbeat) generateEventFromRow(row *sql.Rows, columns []string, query
 		}
 
 		// Set the event column name to the original column name (as default)
-		strEventColName := strColName
+		field := deltaField{name: strColName, base: strColName}
+		isDelta := false
 
-		// Remove unneeded suffix, add _PERSECOND to calculated columns
-		if strings.HasSuffix(strColName, bt.deltaKeyWildcard) {
-			strEventColName = strings.Replace(strColName, bt.deltaKeyWildcard, "", 1)
-		} else if strings.HasSuffix(strColName, bt.deltaWildcard) {
-			strEventColName = strings.Replace(strColName, bt.deltaWildcard, "_PERSECOND", 1)
+		// Remove unneeded suffix, add the delta mode suffix (e.g. _PERSECOND) to calculated columns
+		if strings.HasSuffix(strColName, q.deltaKeyWildcard) {
+			field.name = q.fieldName(strings.Replace(strColName, q.deltaKeyWildcard, "", 1))
+		} else {
+			field, isDelta = q.deltaColumn(strColName)
 		}
 
-		// Try to parse the value to an int64
-		nColValue, err := strconv.ParseInt(strColValue, 0, 64)
-		if err == nil {
-			strColType = columnTypeInt
+		// A NULL Seconds_Behind_Master means the replication is stopped, whatever the nulls policy
+		if queryType == queryTypeSlaveDelay {
+			event[fieldReplicationStopped] = col == nil
 		}
 
-		// Try to parse the value to a float64
-		fColValue, err := strconv.ParseFloat(strColValue, 64)
-		if err == nil {
-			// If it's not already an established int64, set type to float
-			if strColType == columnTypeString {
-				strColType = columnTypeFloat
+		// Convert the value according to the column type, NULL values follow the nulls policy of the query
+		var colValue interface{}
+		if col == nil {
+			var ok bool
+			colValue, ok = q.nullValue(strColName, columns[i])
+			if !ok {
+				continue
 			}
+		} else {
+			colValue = columns[i].convert(col)
 		}
+		rowValues[strColName] = colValue
 
-		// If the column name ends with the deltaWildcard
-		if (queryType == queryTypeSingleRow || queryType == queryTypeMultipleRows) && strings.HasSuffix(strColName, bt.deltaWildcard) {
+		// If the column is a delta column
+		if (queryType == queryTypeSingleRow || queryType == queryTypeMultipleRows) && isDelta {
 
 			var strKey string
+			var err error
 
 			// Get unique row key, if it's a single row - use the column name
+			// Delta values are saved per host and query
 			if queryType == queryTypeSingleRow {
-				strKey = strColName
+				strKey = deltaKey(strColName)
 			} else if queryType == queryTypeMultipleRows {
 
 				// If the query has multiple rows, a unique row key must be defind using the delta key wildcard and the column name
-				strKey, err = getKeyFromRow(bt, values, columns)
+				strKey, err = getKeyFromRow(q, values, columns)
 				if err != nil {
 					return nil, err
 				}
 
-				strKey += strColName
+				strKey = strKey + "|" + deltaKey(strColName)
 			}
 
-			var exists bool
-			_, exists = bt.oldValues[strKey]
-
-			// If an older value doesn't exist
-			if !exists {
-				// Save the current value in the oldValues array
-				bt.oldValuesAge[strKey] = rowAge
-
-				if strColType == columnTypeString {
-					bt.oldValues[strKey] = strColValue
-				} else if strColType == columnTypeInt {
-					bt.oldValues[strKey] = nColValue
-				} else if strColType == columnTypeFloat {
-					bt.oldValues[strKey] = fColValue
-				}
+			if colValue == nil {
+				// A NULL counter has no delta
+				q.putDelta(event, field, nil, deltaResult{}, true)
 			} else {
-				// If found the old value's age
-				if dtOldAge, ok := bt.oldValuesAge[strKey].(time.Time); ok {
-					delta := rowAge.Sub(dtOldAge)
-
-					if strColType == columnTypeInt {
-						var calcVal int64
-
-						// Get old value
-						oldVal, _ := bt.oldValues[strKey].(int64)
-
-						if nColValue > oldVal {
-							// Calculate the delta
-							devResult := float64((nColValue - oldVal)) / float64(delta.Seconds())
-							// Round the calculated result back to an int64
-							calcVal = roundF2I(devResult, .5)
-						} else {
-							calcVal = 0
-						}
-
-						// Add the delta value to the event
-						event[strEventColName] = calcVal
-
-						// Save current values as old values
-						bt.oldValues[strKey] = nColValue
-						bt.oldValuesAge[strKey] = rowAge
-					} else if strColType == columnTypeFloat {
-						var calcVal float64
-						oldVal, _ := bt.oldValues[strKey].(float64)
-
-						if fColValue > oldVal {
-							// Calculate the delta
-							calcVal = (fColValue - oldVal) / float64(delta.Seconds())
-						} else {
-							calcVal = 0
-						}
-
-						// Add the delta value to the event
-						event[strEventColName] = calcVal
-
-						// Save current values as old values
-						bt.oldValues[strKey] = fColValue
-						bt.oldValuesAge[strKey] = rowAge
-					} else {
-						event[strEventColName] = strColValue
-					}
-				}
+				// Add the delta value to the event
+				calcVal, ok := bt.calculateDelta(h, q, strKey, field.mode, colValue, rowAge)
+				q.putDelta(event, field, colValue, calcVal, ok)
 			}
 		} else {
 			// Not a delta column, add the value to the event as is
-			if strColType == columnTypeString {
-				event[strEventColName] = strColValue
-			} else if strColType == columnTypeInt {
-				event[strEventColName] = nColValue
-			} else if strColType == columnTypeFloat {
-				event[strEventColName] = fColValue
-			}
+			event[field.name] = colValue
 		}
 	}
 
+	// Add the ratios of the query, multiple rows need a delta key
+	if len(q.deltaRatios) > 0 && (queryType == queryTypeSingleRow || queryType == queryTypeMultipleRows && rowKey != "") {
+		bt.calculateRatios(h, q, event, rowValues, rowKey, rowAge)
+	}
+
 	// If the event has no data, set to nil
-	if len(event) == 2 {
+	if len(event) == emptyEventLen {
 		event = nil
 	}
 
 	return event, nil
 }
 
-// getKeyFromRow is a function that returns a unique key from row
-func getKeyFromRow(bt *Mysqlbeat, values []sql.RawBytes, columns []string) (strKey string, err error) {
+// newEvent creates an event of the query with no columns data
+func newEvent(h *host, q *query, rowAge time.Time) common.MapStr {
+	event := common.MapStr{
+		"@timestamp": common.Time(rowAge),
+		"type":       q.queryType,
+		"query":      q.name,
+		"host":       h.name,
+	}
+
+	if len(q.tags) > 0 {
+		event["tags"] = q.tags
+	}
+
+	return event
+}
+
+// scanRow reads the raw values of the current row, they are only valid until the next row is read
+func scanRow(row *sql.Rows, count int) ([]sql.RawBytes, error) {
 
-	keyFound := false
+	// Make a slice for the values
+	values := make([]sql.RawBytes, count)
+
+	// Copy the references into such a []interface{} for row.Scan
+	scanArgs := make([]interface{}, len(values))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	// Get RawBytes from data
+	err := row.Scan(scanArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// getKeyFromRow is a function that returns a unique key from row, made of its delta key columns values
+func getKeyFromRow(q *query, values []sql.RawBytes, columns []*column) (string, error) {
+
+	var parts []string
 
 	// Loop on all columns
 	for i, col := range values {
-		// Get column name and string value
-		if strings.HasSuffix(string(columns[i]), bt.deltaKeyWildcard) {
-			strKey += string(col)
-			keyFound = true
+		// Get column name and string value, NULL values are not quoted so they differ from any string
+		if strings.HasSuffix(columns[i].name, q.deltaKeyWildcard) {
+			if col == nil {
+				parts = append(parts, "NULL")
+			} else {
+				parts = append(parts, deltaKey(string(col)))
+			}
 		}
 	}
 
-	if !keyFound {
-		err = fmt.Errorf("query type multiple-rows requires at least one delta key column")
+	if len(parts) == 0 {
+		return "", fmt.Errorf("query type multiple-rows requires at least one delta key column")
 	}
 
-	return strKey, err
+	return strings.Join(parts, "|"), nil
 }
 
 // roundF2I is a function that returns a rounded int64 from a float64
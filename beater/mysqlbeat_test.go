@@ -0,0 +1,108 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"mysqlbeat/config"
+)
+
+func TestQueryBinding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mysqlbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newResumeStore(filepath.Join(dir, "resume.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.set(
+		ResumeIndex{Host: "db1", Index: "orders", Value: "42"},
+		ResumeIndex{Host: "db1", Index: "events", Value: "2020-01-01 10:00:00", Values: []string{"2020-01-01 10:00:00", "7"}},
+		ResumeIndex{Host: "db1", Index: "stale", Value: "1", Values: []string{"1", "2"}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	bt := &Mysqlbeat{resume: store}
+	h := &host{stateKey: "db1"}
+	at := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	single := config.ResumeConfig{Index: "orders", Default: "0", Columns: []string{"id"}}
+	composite := config.ResumeConfig{Index: "events", Columns: []string{"created", "id"}, Defaults: []string{"2000-01-01", "0"}}
+	fresh := config.ResumeConfig{Index: "new", Columns: []string{"created", "id"}}
+	stale := config.ResumeConfig{Index: "stale", Default: "0", Columns: []string{"id"}}
+
+	tests := []struct {
+		name   string
+		resume config.ResumeConfig
+		types  []string
+		sql    string
+		query  string
+		args   []interface{}
+		err    string
+	}{
+		{
+			"resume", single, []string{resumeTypeAuto},
+			"SELECT * FROM orders WHERE id > {resume}",
+			"SELECT * FROM orders WHERE id > ?", []interface{}{int64(42)}, "",
+		},
+		{
+			"quoted placeholders", single, []string{resumeTypeString},
+			`SELECT * FROM orders WHERE id > '{resume}' OR id = "{orders|0|id}"`,
+			"SELECT * FROM orders WHERE id > ? OR id = ?", []interface{}{"42", "42"}, "",
+		},
+		{
+			"columns", composite, []string{resumeTypeDatetime, resumeTypeInt},
+			"SELECT * FROM events WHERE created >= '{resume:created}' AND id > {resume:id}",
+			"SELECT * FROM events WHERE created >= ? AND id > ?", []interface{}{at, int64(7)}, "",
+		},
+		{
+			"cursor", composite, []string{resumeTypeDatetime, resumeTypeInt},
+			"SELECT * FROM events WHERE {cursor} ORDER BY created, id",
+			"SELECT * FROM events WHERE (created, id) > (?, ?) ORDER BY created, id", []interface{}{at, int64(7)}, "",
+		},
+		{
+			"cursor without a value", fresh, []string{resumeTypeDatetime, resumeTypeInt},
+			"SELECT * FROM events WHERE {cursor}",
+			"SELECT * FROM events WHERE 1 = 1", nil, "",
+		},
+		{
+			"bad value", single, []string{resumeTypeDatetime},
+			"SELECT * FROM orders WHERE id > {resume}",
+			"", nil, "placeholder {resume}",
+		},
+		{
+			"saved cursor of other columns", stale, []string{resumeTypeAuto},
+			"SELECT * FROM orders WHERE id > {resume}",
+			"", nil, "has 2 values but the query has 1 resume columns",
+		},
+	}
+
+	for _, test := range tests {
+		q := &query{queryType: queryTypeResumeMultipleRows, sql: test.sql, resume: test.resume,
+			resumeTypes: test.types, location: time.UTC}
+
+		queryStr, args, err := bt.query(h, q)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if queryStr != test.query || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: query = %q %#v, want %q %#v", test.name, queryStr, args, test.query, test.args)
+		}
+	}
+}
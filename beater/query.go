@@ -0,0 +1,416 @@
+package beater
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mysqlbeat/config"
+)
+
+const (
+	// placeholderForms are the forms of the resume placeholders: {index|default|column}, {resume}, {resume:column}
+	// and {cursor}
+	placeholderForms = `\{(?:\w*\|\w*\|\w*|resume(?::\w+)?|cursor)\}`
+)
+
+var (
+	// resumePlaceholder matches both the {index|default|column} form and the {resume} form
+	resumePlaceholder = regexp.MustCompile(`\{\w*\|\w*\|\w*\}|\{resume\}`)
+
+	// resumeColumnPlaceholder is replaced by the value of a resume column ({resume:column})
+	resumeColumnPlaceholder = regexp.MustCompile(`\{resume:(\w+)\}`)
+
+	// queryPlaceholder matches every resume placeholder, also quoted ones ('{resume}') from the time they were
+	// replaced by the value itself, they are all bound as parameters now
+	queryPlaceholder = regexp.MustCompile(`'(` + placeholderForms + `)'|"(` + placeholderForms + `)"|` + placeholderForms)
+
+	// limitClause matches the LIMIT clause at the end of a query, its row count is the page size of the catch-up mode
+	limitClause = regexp.MustCompile(`(?i)\bLIMIT\s+(?:\d+\s*,\s*)?(\d+)(?:\s+OFFSET\s+\d+)?\s*$`)
+)
+
+// query is a single configured query with its own options
+type query struct {
+	name             string
+	sql              string
+	queryType        string
+	period           time.Duration
+	timeout          time.Duration
+	schedule         schedule
+	tags             []string
+	deltaWildcard    string
+	deltaKeyWildcard string
+	resetDetection   string
+	wraparound       bool
+	deltaModes       map[string]string
+	deltaRatios      []config.RatioConfig
+	deltaKeyTTL      int
+	deltaMaxKeys     int
+	deltaRaw         bool
+	deltaFields      map[string]string
+	fieldCase        string
+	resume           config.ResumeConfig
+	columnKinds      map[string]string
+	nulls            string
+	nullDefaults     map[string]string
+	location         *time.Location
+
+	// overlap policy of the query, when it's still running on its next scheduled time
+	overlap string
+
+	// error policy of the query and its consecutive failures (guarded by mu, runs may overlap)
+	onError     string
+	maxFailures int
+	errorEvents bool
+	mu          sync.Mutex
+	failures    int
+	disabled    bool
+
+	// deltaCycle counts the successful runs of the query, to expire the delta keys it doesn't see anymore
+	deltaCycle uint64
+
+	// catch-up mode of a resume-multiple-rows query, it reads pages of pageSize rows within its budget
+	catchUp  bool
+	pageSize int
+	maxRows  int
+	maxTime  time.Duration
+
+	// resumeTypes are the types of the resume columns values, they are bound as parameters
+	resumeTypes []string
+}
+
+// newQuery creates a query from its config, legacyType is the querytypes entry on the same index (if any)
+func newQuery(bt *Mysqlbeat, index int, queryConfig config.QueryConfig, legacyType string) (*query, error) {
+	q := &query{
+		name:         queryConfig.Name,
+		sql:          queryConfig.SQL,
+		queryType:    queryConfig.Type,
+		tags:         queryConfig.Tags,
+		resume:       queryConfig.Resume,
+		columnKinds:  queryConfig.Columns,
+		nulls:        queryConfig.Nulls,
+		nullDefaults: queryConfig.NullDefaults,
+		period:       bt.period,
+		location:     bt.location,
+		overlap:      queryConfig.Overlap,
+		onError:      queryConfig.OnError,
+		maxFailures:  queryConfig.MaxFailures,
+		errorEvents:  queryConfig.ErrorEvents != nil && *queryConfig.ErrorEvents,
+	}
+
+	if q.name == "" {
+		q.name = fmt.Sprintf("query_%d", index+1)
+	}
+
+	if q.queryType == "" {
+		q.queryType = legacyType
+	}
+
+	switch q.queryType {
+	case queryTypeSingleRow, queryTypeMultipleRows, queryTypeTwoColumns, queryTypeSlaveDelay, queryTypeResumeMultipleRows:
+	case "":
+		return nil, fmt.Errorf("query %s has no type (set its type or a querytypes entry on the same index)", q.name)
+	default:
+		return nil, fmt.Errorf("query %s has an unknown type '%s'", q.name, q.queryType)
+	}
+
+	switch q.onError {
+	case "":
+		q.onError = onErrorContinue
+	case onErrorContinue, onErrorFatal:
+	case onErrorDisable:
+		if q.maxFailures < 1 {
+			q.maxFailures = defaultMaxFailures
+		}
+	default:
+		return nil, fmt.Errorf("query %s has an unknown onerror policy '%s'", q.name, q.onError)
+	}
+
+	if err := validateColumnKinds(q.columnKinds); err != nil {
+		return nil, fmt.Errorf("query %s: %v", q.name, err)
+	}
+
+	switch q.nulls {
+	case "":
+		q.nulls = nullsNull
+	case nullsNull, nullsOmit:
+	default:
+		return nil, fmt.Errorf("query %s has an unknown nulls policy '%s'", q.name, q.nulls)
+	}
+
+	switch q.overlap {
+	case "":
+		q.overlap = overlapSkip
+	case overlapSkip, overlapQueue:
+	case overlapConcurrent:
+		// The resume cursor must move forward one run after the other
+		if q.queryType == queryTypeResumeMultipleRows {
+			return nil, fmt.Errorf("query %s of type %s can't use the overlap policy '%s'", q.name, q.queryType, q.overlap)
+		}
+	default:
+		return nil, fmt.Errorf("query %s has an unknown overlap policy '%s'", q.name, q.overlap)
+	}
+
+	strCleanQuery := strings.TrimSpace(strings.ToUpper(q.sql))
+	if !strings.HasPrefix(strCleanQuery, "SELECT") && !strings.HasPrefix(strCleanQuery, "SHOW") || strings.ContainsAny(strCleanQuery, ";") {
+		return nil, fmt.Errorf("Only SELECT/SHOW queries are allowed (the char ; is forbidden)")
+	}
+
+	// The delta settings of the query override the global ones
+	deltaConfig := bt.beatConfig.Mysqlbeat.Delta.Merge(queryConfig.Delta)
+	q.deltaWildcard = deltaConfig.Wildcard
+	q.deltaKeyWildcard = deltaConfig.KeyWildcard
+	q.resetDetection = deltaConfig.ResetDetection
+	q.wraparound = deltaConfig.Wraparound != nil && *deltaConfig.Wraparound
+	q.deltaModes = deltaConfig.Modes
+	q.deltaRatios = deltaConfig.Ratios
+	q.deltaKeyTTL = defaultDeltaKeyTTL
+	if deltaConfig.KeyTTL != nil {
+		q.deltaKeyTTL = *deltaConfig.KeyTTL
+	}
+	q.deltaMaxKeys = deltaConfig.MaxKeys
+	q.deltaRaw = deltaConfig.Raw != nil && *deltaConfig.Raw
+
+	deltaFields, err := newDeltaFieldTemplates(deltaConfig.Naming, deltaConfig.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("query %s: %v", q.name, err)
+	}
+	q.deltaFields = deltaFields
+
+	// The field case of the query overrides the global one
+	q.fieldCase = bt.beatConfig.Mysqlbeat.FieldCase
+	if queryConfig.FieldCase != "" {
+		q.fieldCase = queryConfig.FieldCase
+	}
+
+	switch q.fieldCase {
+	case "":
+		q.fieldCase = fieldCaseNone
+	case fieldCaseNone, fieldCaseLower, fieldCaseSnake:
+	default:
+		return nil, fmt.Errorf("query %s has an unknown field case '%s'", q.name, q.fieldCase)
+	}
+
+	if q.deltaKeyTTL < 0 || q.deltaMaxKeys < 0 {
+		return nil, fmt.Errorf("query %s delta keyttl and maxkeys can't be negative", q.name)
+	}
+
+	switch q.resetDetection {
+	case "":
+		q.resetDetection = resetDetectionDecrease
+	case resetDetectionDecrease, resetDetectionUptime, resetDetectionNone:
+	default:
+		return nil, fmt.Errorf("query %s has an unknown delta reset detection '%s'", q.name, q.resetDetection)
+	}
+
+	for column, mode := range q.deltaModes {
+		if _, ok := deltaModeSuffixes[mode]; !ok {
+			return nil, fmt.Errorf("query %s column %s has an unknown delta mode '%s'", q.name, column, mode)
+		}
+	}
+
+	for _, ratio := range q.deltaRatios {
+		if ratio.Name == "" || ratio.Numerator == "" || ratio.Denominator == "" {
+			return nil, fmt.Errorf("query %s has a delta ratio without a name, numerator or denominator", q.name)
+		}
+	}
+
+	if queryConfig.Period != "" {
+		period, err := time.ParseDuration(queryConfig.Period)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %v", q.name, err)
+		}
+		q.period = period
+	}
+
+	if queryConfig.Timeout != "" {
+		timeout, err := time.ParseDuration(queryConfig.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %v", q.name, err)
+		}
+		q.timeout = timeout
+
+		if queryConfig.MaxExecutionTime != nil && *queryConfig.MaxExecutionTime {
+			q.sql = withMaxExecutionTime(q.sql, q.timeout)
+		}
+	}
+
+	align := bt.beatConfig.Mysqlbeat.Align
+	if queryConfig.Align != nil {
+		align = *queryConfig.Align
+	}
+
+	if queryConfig.Schedule != "" {
+		cron, err := parseCron(queryConfig.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %v", q.name, err)
+		}
+		q.schedule = cron
+	} else if align {
+		q.schedule = alignedSchedule{q.period}
+	} else {
+		q.schedule = periodicSchedule{q.period}
+	}
+
+	if q.queryType == queryTypeResumeMultipleRows {
+		if !queryPlaceholder.MatchString(q.sql) {
+			return nil, fmt.Errorf("query %s of type %s requires a {resume}, {resume:column}, {cursor} or {index|default|column} placeholder", q.name, q.queryType)
+		}
+
+		// The placeholders of a query share its resume settings
+		for _, target := range resumePlaceholder.FindAllString(q.sql, -1) {
+			if first := resumePlaceholder.FindString(q.sql); target != first && target != "{resume}" && first != "{resume}" {
+				return nil, fmt.Errorf("query %s placeholders %s and %s name different resume settings", q.name, first, target)
+			}
+		}
+
+		// Fill the missing resume settings from a {index|default|column} placeholder
+		if target := resumePlaceholder.FindString(q.sql); target != "" && target != "{resume}" {
+			values := strings.Split(strings.Trim(target, "{}"), "|")
+			if q.resume.Index == "" {
+				q.resume.Index = values[0]
+			}
+			if q.resume.Default == "" {
+				q.resume.Default = values[1]
+			}
+			if q.resume.Column == "" {
+				q.resume.Column = values[2]
+			}
+		}
+
+		if q.resume.Index == "" {
+			q.resume.Index = q.name
+		}
+
+		// The cursor is made of the resume columns, or of the single resume column
+		if len(q.resume.Columns) == 0 && q.resume.Column != "" {
+			q.resume.Columns = []string{q.resume.Column}
+		}
+
+		if len(q.resume.Columns) == 0 {
+			return nil, fmt.Errorf("query %s of type %s requires a resume column", q.name, q.queryType)
+		}
+
+		if len(q.resume.Defaults) > 0 && len(q.resume.Defaults) != len(q.resume.Columns) {
+			return nil, fmt.Errorf("query %s resume defaults don't match its resume columns", q.name)
+		}
+
+		for _, match := range resumeColumnPlaceholder.FindAllStringSubmatch(q.sql, -1) {
+			if q.resumeColumn(match[1]) < 0 {
+				return nil, fmt.Errorf("query %s placeholder %s is not a resume column", q.name, match[0])
+			}
+			// Like {resume}, the placeholder needs a value before the first run
+			if len(q.resume.Defaults) == 0 && (q.resume.Default == "" || len(q.resume.Columns) != 1) {
+				return nil, fmt.Errorf("query %s placeholder %s requires resume defaults", q.name, match[0])
+			}
+		}
+
+		// The resume values are bound as parameters of their type, auto binds integers as integers
+		q.resumeTypes = make([]string, len(q.resume.Columns))
+		for i := range q.resumeTypes {
+			q.resumeTypes[i] = resumeTypeAuto
+		}
+		for column, resumeType := range q.resume.Types {
+			i := q.resumeColumn(column)
+			if i < 0 {
+				return nil, fmt.Errorf("query %s resume type of %s which is not a resume column", q.name, column)
+			}
+			switch resumeType {
+			case resumeTypeAuto, resumeTypeInt, resumeTypeDatetime, resumeTypeString:
+			default:
+				return nil, fmt.Errorf("query %s resume column %s has an unknown type '%s'", q.name, column, resumeType)
+			}
+			q.resumeTypes[i] = resumeType
+		}
+
+		if q.resume.CatchUp != nil && *q.resume.CatchUp {
+			if err := q.setCatchUp(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// resumeColumn returns the index of a resume column, -1 if it isn't one
+func (q *query) resumeColumn(name string) int {
+	for i, column := range q.resume.Columns {
+		if column == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// cronIntervalRuns is the number of runs of a cron schedule the default catch-up budget is computed on
+const cronIntervalRuns = 32
+
+// setCatchUp sets the catch-up mode of a resume-multiple-rows query, the page size is the LIMIT of its SQL
+// unless it's set
+func (q *query) setCatchUp() error {
+	q.catchUp = true
+	q.pageSize = q.resume.PageSize
+	q.maxRows = q.resume.MaxRows
+
+	if q.pageSize == 0 {
+		if match := limitClause.FindStringSubmatch(q.sql); match != nil {
+			q.pageSize, _ = strconv.Atoi(match[1])
+		}
+	}
+
+	if q.pageSize < 1 {
+		return fmt.Errorf("query %s in catch-up mode requires a LIMIT clause or a resume pagesize", q.name)
+	}
+
+	if q.maxRows < 0 {
+		return fmt.Errorf("query %s resume maxrows can't be negative", q.name)
+	}
+
+	// The budget is the interval of the schedule, the shortest one between the next runs of a cron schedule
+	q.maxTime = q.period
+	if cron, ok := q.schedule.(*cronSchedule); ok {
+		q.maxTime = cron.minInterval(time.Now(), cronIntervalRuns)
+	}
+	if q.resume.MaxTime != "" {
+		maxTime, err := time.ParseDuration(q.resume.MaxTime)
+		if err != nil {
+			return fmt.Errorf("query %s: %v", q.name, err)
+		}
+		q.maxTime = maxTime
+	}
+
+	return nil
+}
+
+// isDisabled returns true once the error policy disabled the query
+func (q *query) isDisabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.disabled
+}
+
+// currentDeltaCycle returns the delta cycle of the running query
+func (q *query) currentDeltaCycle() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.deltaCycle
+}
+
+// nextDeltaCycle ends the delta cycle of a successful run and returns the new one
+func (q *query) nextDeltaCycle() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.deltaCycle++
+	return q.deltaCycle
+}
+
+// resetFailures clears the consecutive failures after a successful run
+func (q *query) resetFailures() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.failures = 0
+}
@@ -0,0 +1,312 @@
+package beater
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// migratedSuffix is the suffix of a legacy resume file once its values moved to the resume file
+	migratedSuffix = ".migrated"
+
+	// Types of the resume values bound as parameters
+	resumeTypeAuto     = "auto"
+	resumeTypeInt      = "int"
+	resumeTypeDatetime = "datetime"
+	resumeTypeString   = "string"
+)
+
+var (
+	// resumeDatetimeLayouts are the accepted layouts of a datetime resume value, read in the time zone of the beat
+	// which the driver writes them in as well
+	resumeDatetimeLayouts = []string{"2006-01-02 15:04:05.999999999", "2006-01-02", time.RFC3339Nano}
+)
+
+// ResumeIndex is the resume value of a resume-multiple-rows query of a host, a line of the resume file.
+// Values holds all the values of a composite cursor, Value its first one.
+type ResumeIndex struct {
+	Host   string   `json:"host,omitempty"`
+	Index  string   `json:"index"`
+	Value  string   `json:"value"`
+	Values []string `json:"values,omitempty"`
+}
+
+// resumeStore holds the resume values and saves them to the resume file, it's safe for concurrent use.
+// The file is replaced atomically on every change and its previous generation is kept as a backup.
+type resumeStore struct {
+	mu      sync.Mutex
+	path    string
+	indexes []ResumeIndex
+}
+
+// newResumeStore loads the resume values of a resume file, the backup is used when the file is missing
+// or corrupted (e.g. by a crash of a previous version which rewrote it in place)
+func newResumeStore(path string) (*resumeStore, error) {
+	s := &resumeStore{path: path}
+
+	indexes, err := readResumeFile(path)
+	if err == nil {
+		s.indexes = indexes
+		return s, nil
+	}
+
+	backup := path + backupSuffix
+	backupIndexes, backupErr := readResumeFile(backup)
+	if backupErr == nil {
+		if !os.IsNotExist(err) {
+			logp.Warn("Resume file %s is not valid (%v), recovering the resume values from %s", path, err, backup)
+		}
+		s.indexes = backupIndexes
+		return s, nil
+	}
+
+	// A new resume file
+	if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+		return s, nil
+	}
+
+	if os.IsNotExist(err) {
+		path, err = backup, backupErr
+	}
+	return nil, fmt.Errorf("cannot load the resume values from %s: %v (fix or remove the file to start over)", path, err)
+}
+
+// migrateResumeFile moves the resume values of a legacy resume file to a resume file that doesn't exist yet,
+// so moving the resume file doesn't restart the resume queries from their default. The legacy file (and its backup)
+// is renamed once migrated.
+func migrateResumeFile(legacy string, path string) error {
+	if samePath(legacy, path) || exists(path) || exists(path+backupSuffix) {
+		return nil
+	}
+	if !exists(legacy) && !exists(legacy+backupSuffix) {
+		return nil
+	}
+
+	legacyStore, err := newResumeStore(legacy)
+	if err != nil {
+		return err
+	}
+
+	indexes := legacyStore.list()
+	if err := writeResumeFile(path, indexes); err != nil {
+		return fmt.Errorf("cannot move the resume values from %s to %s: %v", legacy, path, err)
+	}
+
+	for _, file := range []string{legacy, legacy + backupSuffix} {
+		if err := os.Rename(file, file+migratedSuffix); err != nil && !os.IsNotExist(err) {
+			logp.Warn("Cannot rename the migrated resume file %s: %v", file, err)
+		}
+	}
+
+	logp.Info("Moved %d resume values from %s to %s", len(indexes), legacy, path)
+	return nil
+}
+
+// readResumeFile reads and validates the resume values of a resume file
+func readResumeFile(path string) ([]ResumeIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readResumeIndexes(file)
+}
+
+// readResumeIndexes reads and validates resume values, one JSON ResumeIndex per line
+func readResumeIndexes(r io.Reader) ([]ResumeIndex, error) {
+	var indexes []ResumeIndex
+	seen := map[resumeKey]bool{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var m ResumeIndex
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if m.Index == "" {
+			return nil, fmt.Errorf("line %d: no resume index", line)
+		}
+
+		if len(m.Values) > 0 && m.Values[0] != m.Value {
+			return nil, fmt.Errorf("line %d: resume index %s values don't match its value", line, m.Index)
+		}
+
+		key := resumeKey{host: m.Host, index: m.Index}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: resume index %s is saved more than once", line, m.Index)
+		}
+		seen[key] = true
+
+		indexes = append(indexes, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return indexes, nil
+}
+
+// resumeKey identifies the resume value of an index of a host
+type resumeKey struct {
+	host  string
+	index string
+}
+
+// get returns the resume value of an index of a host
+func (s *resumeStore) get(host string, index string) (ResumeIndex, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.indexes {
+		if m.Host == host && m.Index == index {
+			return m, true
+		}
+	}
+	return ResumeIndex{}, false
+}
+
+// cursor returns the values of the resume cursor
+func (m ResumeIndex) cursor() []string {
+	if len(m.Values) > 0 {
+		return m.Values
+	}
+	return []string{m.Value}
+}
+
+// cursorPredicate returns the predicate of a composite cursor, (a, b) > (?, ?), and its arguments.
+// There is no cursor before the first run without defaults, all the rows match then.
+func cursorPredicate(columns []string, types []string, values []string, location *time.Location) (string, []interface{}, error) {
+	if len(values) == 0 {
+		return "1 = 1", nil, nil
+	}
+	if len(values) != len(columns) {
+		return "", nil, fmt.Errorf("the resume cursor has %d values for %d resume columns", len(values), len(columns))
+	}
+
+	params := make([]string, len(columns))
+	args := make([]interface{}, len(columns))
+	for i := range columns {
+		arg, err := resumeArg(values[i], types[i], location)
+		if err != nil {
+			return "", nil, fmt.Errorf("resume column %s: %v", columns[i], err)
+		}
+		params[i] = "?"
+		args[i] = arg
+	}
+
+	if len(columns) == 1 {
+		return fmt.Sprintf("%s > ?", columns[0]), args, nil
+	}
+	return fmt.Sprintf("(%s) > (%s)", strings.Join(columns, ", "), strings.Join(params, ", ")), args, nil
+}
+
+// resumeArg returns a resume value as a parameter of its type
+func resumeArg(value string, resumeType string, location *time.Location) (interface{}, error) {
+	switch resumeType {
+	case resumeTypeInt:
+		return strconv.ParseInt(value, 10, 64)
+	case resumeTypeDatetime:
+		for _, layout := range resumeDatetimeLayouts {
+			if t, err := time.ParseInLocation(layout, value, location); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("'%s' is not a datetime", value)
+	case resumeTypeString:
+		return value, nil
+	}
+
+	// auto binds integers as integers, anything else as a string
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i, nil
+	}
+	return value, nil
+}
+
+// set saves the resume values of indexes of hosts, all of them with a single write of the resume file
+func (s *resumeStore) set(resumeIndexes ...ResumeIndex) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes := append(make([]ResumeIndex, 0, len(s.indexes)+len(resumeIndexes)), s.indexes...)
+	for _, resumeIndex := range resumeIndexes {
+		found := false
+		for i, m := range indexes {
+			if m.Host == resumeIndex.Host && m.Index == resumeIndex.Index {
+				indexes[i].Value = resumeIndex.Value
+				indexes[i].Values = resumeIndex.Values
+				found = true
+			}
+		}
+		if !found {
+			indexes = append(indexes, resumeIndex)
+		}
+	}
+
+	if err := writeResumeFile(s.path, indexes); err != nil {
+		return err
+	}
+
+	s.indexes = indexes
+	return nil
+}
+
+// remove deletes the resume value of an index of a host, the query starts over from its default.
+// It returns false if the index has no resume value.
+func (s *resumeStore) remove(host string, index string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes := make([]ResumeIndex, 0, len(s.indexes))
+	for _, m := range s.indexes {
+		if m.Host != host || m.Index != index {
+			indexes = append(indexes, m)
+		}
+	}
+	if len(indexes) == len(s.indexes) {
+		return false, nil
+	}
+
+	if err := writeResumeFile(s.path, indexes); err != nil {
+		return false, err
+	}
+
+	s.indexes = indexes
+	return true, nil
+}
+
+// list returns a copy of the resume values
+func (s *resumeStore) list() []ResumeIndex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]ResumeIndex(nil), s.indexes...)
+}
+
+// writeResumeFile replaces the content of a resume file, keeping its previous generation as a backup
+func writeResumeFile(path string, indexes []ResumeIndex) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range indexes {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, buf.Bytes(), true)
+}
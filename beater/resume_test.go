@@ -0,0 +1,190 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadResumeIndexes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		indexes []ResumeIndex
+		err     string
+	}{
+		{"empty", "", nil, ""},
+		{"blank lines", "\n{\"index\":\"a\",\"value\":\"1\"}\n  \n", []ResumeIndex{{Index: "a", Value: "1"}}, ""},
+		{
+			"hosts and composite cursor",
+			`{"host":"db1","index":"a","value":"1"}` + "\n" +
+				`{"host":"db2","index":"a","value":"2","values":["2","x"]}` + "\n",
+			[]ResumeIndex{{Host: "db1", Index: "a", Value: "1"}, {Host: "db2", Index: "a", Value: "2", Values: []string{"2", "x"}}},
+			"",
+		},
+		{"bad JSON", `{"index":"a","value":"1"}` + "\n" + `{"index":"b",`, nil, "line 2"},
+		{"no index", `{"value":"1"}`, nil, "no resume index"},
+		{"values mismatch", `{"index":"a","value":"1","values":["2","x"]}`, nil, "don't match"},
+		{"duplicate", `{"index":"a","value":"1"}` + "\n" + `{"index":"a","value":"2"}`, nil, "more than once"},
+	}
+
+	for _, test := range tests {
+		indexes, err := readResumeIndexes(strings.NewReader(test.content))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(indexes, test.indexes) {
+			t.Errorf("%s: indexes = %+v, want %+v", test.name, indexes, test.indexes)
+		}
+	}
+}
+
+func TestResumeStoreBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mysqlbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "resume.json")
+
+	// A new resume file
+	s, err := newResumeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.list()) != 0 {
+		t.Fatalf("new resume store = %+v, want no values", s.list())
+	}
+
+	first := ResumeIndex{Index: "a", Value: "1"}
+	second := ResumeIndex{Index: "a", Value: "2"}
+	if err := s.set(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup holds the previous generation
+	backup, err := readResumeFile(path + backupSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(backup, []ResumeIndex{first}) {
+		t.Errorf("backup = %+v, want %+v", backup, []ResumeIndex{first})
+	}
+
+	// A corrupted resume file is recovered from the backup
+	if err := ioutil.WriteFile(path, []byte(`{"index":`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err = newResumeStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.list(), []ResumeIndex{first}) {
+		t.Errorf("recovered values = %+v, want %+v", s.list(), []ResumeIndex{first})
+	}
+
+	// So is a missing one
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newResumeStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.list(), []ResumeIndex{first}) {
+		t.Errorf("recovered values = %+v, want %+v", s.list(), []ResumeIndex{first})
+	}
+
+	// Both corrupted: an error naming the resume file rather than starting over
+	for _, file := range []string{path, path + backupSuffix} {
+		if err := ioutil.WriteFile(file, []byte("not JSON\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := newResumeStore(path); err == nil || !strings.Contains(err.Error(), path+":") {
+		t.Errorf("corrupted resume file and backup error = %v, want an error about %s", err, path)
+	}
+}
+
+func TestResumeArg(t *testing.T) {
+	location := time.FixedZone("UTC+2", 2*60*60)
+
+	tests := []struct {
+		value      string
+		resumeType string
+		arg        interface{}
+		ok         bool
+	}{
+		{"42", resumeTypeAuto, int64(42), true},
+		{"-42", resumeTypeAuto, int64(-42), true},
+		{"2020-01-01", resumeTypeAuto, "2020-01-01", true},
+		{"42", resumeTypeString, "42", true},
+		{"42", resumeTypeInt, int64(42), true},
+		{"4.2", resumeTypeInt, nil, false},
+		{"2020-01-01 10:00:00", resumeTypeDatetime, time.Date(2020, 1, 1, 10, 0, 0, 0, location), true},
+		{"2020-01-01 10:00:00.5", resumeTypeDatetime, time.Date(2020, 1, 1, 10, 0, 0, 500000000, location), true},
+		{"2020-01-01", resumeTypeDatetime, time.Date(2020, 1, 1, 0, 0, 0, 0, location), true},
+		{"2020-01-01T10:00:00Z", resumeTypeDatetime, time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), true},
+		{"yesterday", resumeTypeDatetime, nil, false},
+	}
+
+	for _, test := range tests {
+		arg, err := resumeArg(test.value, test.resumeType, location)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("resumeArg(%q, %s) error = %v, want ok %v", test.value, test.resumeType, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+
+		if want, isTime := test.arg.(time.Time); isTime {
+			if got, _ := arg.(time.Time); !got.Equal(want) {
+				t.Errorf("resumeArg(%q, %s) = %v, want %v", test.value, test.resumeType, arg, want)
+			}
+		} else if !reflect.DeepEqual(arg, test.arg) {
+			t.Errorf("resumeArg(%q, %s) = %#v, want %#v", test.value, test.resumeType, arg, test.arg)
+		}
+	}
+}
+
+func TestCursorPredicate(t *testing.T) {
+	tests := []struct {
+		columns   []string
+		types     []string
+		values    []string
+		predicate string
+		args      []interface{}
+		ok        bool
+	}{
+		{[]string{"id"}, []string{resumeTypeAuto}, []string{"5"}, "id > ?", []interface{}{int64(5)}, true},
+		{[]string{"day", "id"}, []string{resumeTypeString, resumeTypeInt}, []string{"mon", "5"}, "(day, id) > (?, ?)", []interface{}{"mon", int64(5)}, true},
+		{[]string{"day", "id"}, []string{resumeTypeString, resumeTypeInt}, nil, "1 = 1", nil, true},
+		{[]string{"day", "id"}, []string{resumeTypeString, resumeTypeInt}, []string{"mon"}, "", nil, false},
+		{[]string{"day", "id"}, []string{resumeTypeString, resumeTypeInt}, []string{"mon", "x"}, "", nil, false},
+	}
+
+	for _, test := range tests {
+		predicate, args, err := cursorPredicate(test.columns, test.types, test.values, time.UTC)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("cursorPredicate(%q, %q) error = %v, want ok %v", test.columns, test.values, err, test.ok)
+			continue
+		}
+		if predicate != test.predicate || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("cursorPredicate(%q, %q) = %q %#v, want %q %#v", test.columns, test.values, predicate, args, test.predicate, test.args)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package beater
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// resumeUsage is the usage of the resume subcommands
+const resumeUsage = `usage: mysqlbeat resume <command> [-c mysqlbeat.yml] [-file resume file] [-host name] [arguments]
+  list                      print the resume values
+  set <index> <value>...    set the resume value of an index (one value per column of a composite cursor)
+  reset <index>             remove the resume value of an index, the query starts over from its default
+  export                    print the resume values as JSON lines
+  import [file]             merge the resume values of JSON lines (from the standard input without a file)`
+
+// ResumeCommand runs a resume subcommand of mysqlbeat:
+//
+//	mysqlbeat resume list|set <index> <value>...|reset <index>|export|import [file]
+//
+// The resume file is the one of the configuration (-c), the values set or imported are checked against
+// the resume queries of the configuration. The commands editing the resume file refuse to run while
+// a running mysqlbeat holds its lock.
+func ResumeCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(resumeUsage)
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet("resume "+command, flag.ContinueOnError)
+	configFile := flags.String("c", defaultConfigFile(), "configuration file")
+	path := flags.String("file", "", "resume file (default: the resume file of the configuration)")
+	hostName := flags.String("host", "", "host of the resume values (empty without a hosts array)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	bt, err := newCommandBeat(*configFile)
+	if err != nil {
+		return err
+	}
+	if *path == "" {
+		*path = bt.resumeFile()
+	}
+
+	switch command {
+	case "list", "export":
+		if len(args) != 0 {
+			return errors.New(resumeUsage)
+		}
+
+		// Reading doesn't need the lock, the resume file is always replaced atomically
+		s, err := newResumeStore(*path)
+		if err != nil {
+			return err
+		}
+
+		hostSet := false
+		flags.Visit(func(f *flag.Flag) { hostSet = hostSet || f.Name == "host" })
+
+		var indexes []ResumeIndex
+		for _, m := range s.list() {
+			if !hostSet || m.Host == *hostName {
+				indexes = append(indexes, m)
+			}
+		}
+
+		if command == "export" {
+			return exportResumeIndexes(os.Stdout, indexes)
+		}
+		return listResumeIndexes(indexes)
+
+	case "set", "reset", "import":
+		lock, err := lockStateFile(*path)
+		if err != nil {
+			return fmt.Errorf("cannot edit the resume values: %v", err)
+		}
+		defer lock.unlock()
+
+		s, err := newResumeStore(*path)
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case "set":
+			if len(args) < 2 {
+				return errors.New(resumeUsage)
+			}
+
+			m := ResumeIndex{Host: *hostName, Index: args[0], Value: args[1]}
+			if len(args) > 2 {
+				m.Values = args[1:]
+			}
+			if err := bt.checkResumeIndexes(m); err != nil {
+				return err
+			}
+			if err := s.set(m); err != nil {
+				return err
+			}
+			fmt.Printf("Resume index %s of host '%s' set to %s\n", m.Index, m.Host, strings.Join(m.cursor(), ", "))
+
+		case "reset":
+			if len(args) != 1 {
+				return errors.New(resumeUsage)
+			}
+
+			removed, err := s.remove(*hostName, args[0])
+			if err != nil {
+				return err
+			}
+			if !removed {
+				return fmt.Errorf("resume index %s of host '%s' has no resume value", args[0], *hostName)
+			}
+			fmt.Printf("Resume index %s of host '%s' reset\n", args[0], *hostName)
+
+		case "import":
+			if len(args) > 1 {
+				return errors.New(resumeUsage)
+			}
+
+			var r io.Reader = os.Stdin
+			if len(args) == 1 && args[0] != "-" {
+				file, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				r = file
+			}
+
+			indexes, err := readResumeIndexes(r)
+			if err != nil {
+				return fmt.Errorf("cannot import the resume values: %v", err)
+			}
+			if err := bt.checkResumeIndexes(indexes...); err != nil {
+				return fmt.Errorf("cannot import the resume values: %v", err)
+			}
+			if err := s.set(indexes...); err != nil {
+				return err
+			}
+			fmt.Printf("Imported %d resume values to %s\n", len(indexes), *path)
+		}
+		return nil
+	}
+
+	return errors.New(resumeUsage)
+}
+
+// checkResumeIndexes checks resume values against the resume queries of the configuration,
+// every value must be of a resume query of its host with one value per resume column of the query
+func (bt *Mysqlbeat) checkResumeIndexes(indexes ...ResumeIndex) error {
+	hosts, err := bt.newHosts()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range indexes {
+		found := false
+		for _, h := range hosts {
+			if h.stateKey != m.Host {
+				continue
+			}
+
+			for _, q := range h.queries {
+				if q.queryType != queryTypeResumeMultipleRows || q.resume.Index != m.Index {
+					continue
+				}
+				found = true
+
+				values := m.cursor()
+				if len(values) != len(q.resume.Columns) {
+					return fmt.Errorf("resume index %s of host '%s' needs %d values (%s), not %d",
+						m.Index, m.Host, len(q.resume.Columns), strings.Join(q.resume.Columns, ", "), len(values))
+				}
+				for i, value := range values {
+					if _, err := resumeArg(value, q.resumeTypes[i], q.location); err != nil {
+						return fmt.Errorf("resume index %s of host '%s' column %s: %v", m.Index, m.Host, q.resume.Columns[i], err)
+					}
+				}
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("no resume-multiple-rows query of host '%s' uses the resume index %s", m.Host, m.Index)
+		}
+	}
+	return nil
+}
+
+// listResumeIndexes prints the resume values as a table, sorted by host and index
+func listResumeIndexes(indexes []ResumeIndex) error {
+	sort.Slice(indexes, func(i, j int) bool {
+		if indexes[i].Host != indexes[j].Host {
+			return indexes[i].Host < indexes[j].Host
+		}
+		return indexes[i].Index < indexes[j].Index
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tINDEX\tVALUE")
+	for _, m := range indexes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.Host, m.Index, strings.Join(m.cursor(), ", "))
+	}
+	return w.Flush()
+}
+
+// exportResumeIndexes writes the resume values in the format of the resume file, one JSON ResumeIndex per line
+func exportResumeIndexes(w io.Writer, indexes []ResumeIndex) error {
+	encoder := json.NewEncoder(w)
+	for _, m := range indexes {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package beater
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// schedule returns the next run time of a job after the given time
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// periodicSchedule runs a job every period
+type periodicSchedule struct {
+	period time.Duration
+}
+
+func (s periodicSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.period)
+}
+
+func (s periodicSchedule) String() string {
+	return fmt.Sprintf("every %v", s.period)
+}
+
+// alignedSchedule runs a job every period on local wall-clock boundaries (e.g. :00, :10, :20 for 10m),
+// so that events of several beats line up in time
+type alignedSchedule struct {
+	period time.Duration
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(s.period).Add(s.period).Add(-shift)
+}
+
+func (s alignedSchedule) String() string {
+	return fmt.Sprintf("every %v aligned", s.period)
+}
+
+const (
+	// overlap policies values, what happens when a job is still running on its next scheduled time
+	overlapSkip       = "skip"
+	overlapQueue      = "queue"
+	overlapConcurrent = "concurrent"
+)
+
+var (
+	skippedRuns = expvar.NewInt("mysqlbeat.scheduler.skipped")
+)
+
+// job is a function that the scheduler runs on its own schedule
+type job struct {
+	name     string
+	schedule schedule
+	overlap  string
+	run      func()
+
+	// mu guards the run state of the job
+	mu      sync.Mutex
+	running int
+	pending bool
+	skipped int64
+}
+
+// scheduler runs every job in its own goroutine, so a slow job never delays the others
+type scheduler struct {
+	jobs []*job
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		done: make(chan struct{}),
+	}
+}
+
+// add registers a job, it must be called before start
+func (s *scheduler) add(name string, sched schedule, overlap string, run func()) {
+	s.jobs = append(s.jobs, &job{name: name, schedule: sched, overlap: overlap, run: run})
+}
+
+// start launches all the jobs, the first run of each job is on its first scheduled time
+func (s *scheduler) start() {
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+}
+
+// stop stops all the jobs and waits for the running ones to finish
+func (s *scheduler) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+func (s *scheduler) loop(j *job) {
+	defer s.wg.Done()
+
+	next := j.schedule.Next(time.Now())
+	timer := time.NewTimer(next.Sub(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-timer.C:
+			s.fire(j)
+
+			// Keep the job on its schedule, times already passed (e.g. the machine was suspended) are skipped
+			now := time.Now()
+			missed := 0
+			next = j.schedule.Next(next)
+			for !next.After(now) {
+				next = j.schedule.Next(next)
+				missed++
+			}
+			if missed > 0 {
+				j.skip(missed)
+			}
+
+			timer.Reset(next.Sub(now))
+		}
+	}
+}
+
+// fire runs the job on its scheduled time according to its overlap policy
+func (s *scheduler) fire(j *job) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running == 0 || j.overlap == overlapConcurrent {
+		s.launch(j)
+		return
+	}
+
+	// Queue at most one run, it starts as soon as the running one is done
+	if j.overlap == overlapQueue && !j.pending {
+		j.pending = true
+		return
+	}
+
+	j.skipLocked(1)
+}
+
+// launch runs the job in a new goroutine, then the queued run (if any), it must be called with j.mu held
+func (s *scheduler) launch(j *job) {
+	j.running++
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			j.run()
+
+			j.mu.Lock()
+			if j.pending && !s.stopped() {
+				j.pending = false
+				j.mu.Unlock()
+				continue
+			}
+			j.running--
+			j.mu.Unlock()
+			return
+		}
+	}()
+}
+
+func (s *scheduler) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// skip counts runs of the job that were skipped
+func (j *job) skip(count int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.skipLocked(count)
+}
+
+func (j *job) skipLocked(count int) {
+	j.skipped += int64(count)
+	skippedRuns.Add(int64(count))
+	logp.Warn("Job %s skipped %d run(s), it was still running or late (%d skipped so far)", j.name, count, j.skipped)
+}
@@ -0,0 +1,112 @@
+package beater
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// backupSuffix is the suffix of the previous generation of a state file
+	backupSuffix = ".bak"
+
+	// stateFileMode is the mode of the state files, the resume values end up in queries so only the owner may write them
+	stateFileMode = 0600
+)
+
+// statePath returns the path of a state file, a relative file is in the data path
+func statePath(dataPath string, file string) string {
+	if dataPath == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dataPath, file)
+}
+
+// samePath returns true if two paths name the same file
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// exists returns true if a file exists, or if it can't tell
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// writeFileAtomic replaces the content of a state file, the data is written to a temporary file which is synced
+// and renamed over the state file, so a crash never leaves a partially written state file behind.
+// With backup the previous state file is kept as the .bak file, the state file is never missing meanwhile.
+func writeFileAtomic(path string, data []byte, backup bool) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), stateFileMode)
+	}
+	if err == nil && backup {
+		err = backupFile(path)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// Sync the directory so the rename survives a crash
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// backupFile keeps the current content of a state file as its .bak file, the state file stays in place.
+// The backup is a hard link, or a copy where hard links aren't supported, renamed over the previous backup.
+func backupFile(path string) error {
+	tmpBackup := path + backupSuffix + ".tmp"
+	os.Remove(tmpBackup)
+
+	err := os.Link(path, tmpBackup)
+	if err != nil && !os.IsNotExist(err) {
+		err = copyFile(path, tmpBackup)
+	}
+	if os.IsNotExist(err) {
+		// No state file yet
+		return nil
+	}
+	if err == nil {
+		err = os.Rename(tmpBackup, path+backupSuffix)
+	}
+
+	if err != nil {
+		os.Remove(tmpBackup)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies a state file
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, stateFileMode)
+}
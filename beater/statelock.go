@@ -0,0 +1,79 @@
+package beater
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// lockSuffix is the suffix of the lock file of a state file
+const lockSuffix = ".lock"
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// stateLock is the lock of a state file, so two processes never share (and clobber) the same state.
+// The lock is held on the open lock file and released by the system when the process is gone,
+// the PID saved in the lock file only tells which process holds it.
+type stateLock struct {
+	path string
+	file *os.File
+}
+
+// lockStateFile locks a state file, it fails if another process holds the lock
+func lockStateFile(path string) (*stateLock, error) {
+	lockPath := path + lockSuffix
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0750); err != nil {
+		return nil, err
+	}
+
+	file, err := lockFile(lockPath)
+	if err == errLocked {
+		if pid := lockOwner(lockPath); pid > 0 {
+			return nil, fmt.Errorf("%s is locked by the running process %d (%s), use another state file for every instance", path, pid, lockPath)
+		}
+		return nil, fmt.Errorf("%s is locked by a running process (%s), use another state file for every instance", path, lockPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The lock file is never removed, a process could hold the lock of the removed file while another one locks a new file
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+		file.Sync()
+	}
+
+	return &stateLock{path: lockPath, file: file}, nil
+}
+
+// lockOwner returns the PID saved in a lock file, 0 if it can't be read
+func lockOwner(lockPath string) int {
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// unlock releases the lock
+func (l *stateLock) unlock() {
+	if l == nil {
+		return
+	}
+
+	if err := l.file.Close(); err != nil {
+		logp.Warn("Cannot release the lock %s: %v", l.path, err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package beater
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile opens a lock file and takes an exclusive lock on it without waiting
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,27 @@
+package beater
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is returned when another process has the file open
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile opens a lock file without sharing it, which locks it until the file is closed
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, errLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
@@ -0,0 +1,103 @@
+package beater
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	// killTimeout bounds the KILL QUERY sent after a query timed out
+	killTimeout = 5 * time.Second
+)
+
+var (
+	queryTimeouts = expvar.NewInt("mysqlbeat.query.timeouts")
+)
+
+// queryTimeoutError is returned when a query runs longer than its timeout
+type queryTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *queryTimeoutError) Error() string {
+	return fmt.Sprintf("query timed out after %v", e.timeout)
+}
+
+// context returns the context of a query run, canceled after the query timeout (if any)
+func (q *query) context() (context.Context, context.CancelFunc) {
+	if q.timeout > 0 {
+		return context.WithTimeout(context.Background(), q.timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// conn returns a dedicated connection of the host and its MySQL connection id (when it may need to be killed)
+func (h *host) conn(ctx context.Context, withID bool) (*sql.Conn, int64, error) {
+	conn, err := h.db.Conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var connectionID int64
+	if withID {
+		err = conn.QueryRowContext(ctx, "SELECT CONNECTION_ID()").Scan(&connectionID)
+		if err != nil {
+			conn.Close()
+			return nil, 0, err
+		}
+	}
+
+	return conn, connectionID, nil
+}
+
+// queryError replaces the error of a query that timed out, the query is killed on the server which would
+// keep running it otherwise
+func (h *host) queryError(ctx context.Context, q *query, connectionID int64, err error) error {
+	if ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+
+	queryTimeouts.Add(1)
+
+	if connectionID > 0 {
+		h.killQuery(connectionID)
+	}
+
+	return &queryTimeoutError{timeout: q.timeout}
+}
+
+// killQuery kills the statement running on a MySQL connection. The KILL is sent on a dedicated connection,
+// the pool may have no free connection (maxopenconns) while the timed out one is still checked out.
+func (h *host) killQuery(connectionID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+
+	db, err := sql.Open("mysql", h.dsn())
+	if err != nil {
+		logp.Err("Host %v error killing query on connection %d: %v", h.name, connectionID, err)
+		return
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("KILL QUERY %d", connectionID))
+	if err != nil {
+		logp.Err("Host %v error killing query on connection %d: %v", h.name, connectionID, err)
+	}
+}
+
+// withMaxExecutionTime adds a MAX_EXECUTION_TIME optimizer hint to a SELECT query, so that the server
+// aborts it by itself (MySQL 5.7.8 and later)
+func withMaxExecutionTime(sqlStr string, timeout time.Duration) string {
+	trimmed := strings.TrimSpace(sqlStr)
+	if !strings.HasPrefix(strings.ToUpper(trimmed), "SELECT") {
+		return sqlStr
+	}
+
+	return fmt.Sprintf("%s /*+ MAX_EXECUTION_TIME(%d) */%s", trimmed[:6], timeout/time.Millisecond, trimmed[6:])
+}
@@ -8,14 +8,293 @@ type Config struct {
 }
 
 type MysqlbeatConfig struct {
-	Period            string   `yaml:"period"`
-	Hostname          string   `yaml:"hostname"`
-	Port              string   `yaml:"port"`
-	Username          string   `yaml:"username"`
-	Password          string   `yaml:"password"`
-	EncryptedPassword string   `yaml:"encryptedpassword"`
-	Queries           []string `yaml:"queries"`
-	QueryTypes        []string `yaml:"querytypes"`
-	DeltaWildcard     string   `yaml:"deltawildcard"`
-	DeltaKeyWildcard  string   `yaml:"deltakeywildcard"`
+	Period            string        `yaml:"period"`
+	Hostname          string        `yaml:"hostname"`
+	Port              string        `yaml:"port"`
+	Username          string        `yaml:"username"`
+	Password          string        `yaml:"password"`
+	EncryptedPassword string        `yaml:"encryptedpassword"`
+	Queries           []QueryConfig `yaml:"queries"`
+	QueryTypes        []string      `yaml:"querytypes"`
+	DeltaWildcard     string        `yaml:"deltawildcard"`
+	DeltaKeyWildcard  string        `yaml:"deltakeywildcard"`
+	Hosts             []HostConfig  `yaml:"hosts"`
+	MaxOpenConns      int           `yaml:"maxopenconns"`
+	MaxIdleConns      int           `yaml:"maxidleconns"`
+	ConnMaxLifetime   string        `yaml:"connmaxlifetime"`
+	Align             bool          `yaml:"align"`
+	Concurrency       int           `yaml:"concurrency"`
+	Delta             DeltaConfig   `yaml:"delta"`
+
+	// DeltaState checkpoints the delta values to a file, so the rates go on after a restart
+	DeltaState DeltaStateConfig `yaml:"deltastate"`
+
+	// FieldCase changes the case of the column names in the events: none, lower or snake
+	FieldCase string `yaml:"fieldcase"`
+
+	// TimeZone is the time zone of the DATETIME, TIMESTAMP and DATE values and of the datetime resume values (Local by default)
+	TimeZone string `yaml:"timezone"`
+
+	// ResumeFile is where the resume values are saved, DataPath is the directory of the state files
+	// with a relative path (the current directory by default)
+	ResumeFile string `yaml:"resumefile"`
+	DataPath   string `yaml:"datapath"`
+}
+
+// DeltaStateConfig holds the delta state file settings, values older than MaxAge are discarded on startup
+type DeltaStateConfig struct {
+	Enabled    *bool  `yaml:"enabled"`
+	File       string `yaml:"file"`
+	MaxAge     string `yaml:"maxage"`
+	Checkpoint string `yaml:"checkpoint"`
+}
+
+// HostConfig describes a MySQL server to monitor, empty connection settings fall back to the global ones.
+// Every global query runs against every host, a host query with the name of a global query overrides
+// its non-empty options (enabled: false disables it on this host), other host queries run on this host only.
+type HostConfig struct {
+	Name              string        `yaml:"name"`
+	Hostname          string        `yaml:"hostname"`
+	Port              string        `yaml:"port"`
+	Username          string        `yaml:"username"`
+	Password          string        `yaml:"password"`
+	EncryptedPassword string        `yaml:"encryptedpassword"`
+	Queries           []QueryConfig `yaml:"queries"`
+}
+
+// QueryConfig describes a single query and its own options.
+// A plain string in the queries array is decoded as a QueryConfig holding only the SQL,
+// its type is then taken from the querytypes array on the same index.
+type QueryConfig struct {
+	Name    string       `yaml:"name"`
+	SQL     string       `yaml:"sql"`
+	Type    string       `yaml:"type"`
+	Period  string       `yaml:"period"`
+	Tags    []string     `yaml:"tags"`
+	Delta   DeltaConfig  `yaml:"delta"`
+	Resume  ResumeConfig `yaml:"resume"`
+	Enabled *bool        `yaml:"enabled"`
+
+	// Schedule is a cron expression that replaces the period, Align aligns the period on wall-clock boundaries
+	Schedule string `yaml:"schedule"`
+	Align    *bool  `yaml:"align"`
+
+	// Timeout cancels the query (and kills it on the server), MaxExecutionTime also adds a MAX_EXECUTION_TIME hint to SELECT queries
+	Timeout          string `yaml:"timeout"`
+	MaxExecutionTime *bool  `yaml:"maxexecutiontime"`
+
+	// Columns overrides the type of the values of a column (auto, string, int, float, decimal, bool, time, date, seconds, bit, json or bytes)
+	Columns map[string]string `yaml:"columns"`
+
+	// Nulls is what happens to NULL values: null (sent as JSON null) or omit, NullDefaults replaces them per column
+	Nulls        string            `yaml:"nulls"`
+	NullDefaults map[string]string `yaml:"nulldefaults"`
+
+	// Overlap is what happens when the query is still running on its next scheduled time: skip, queue or concurrent
+	Overlap string `yaml:"overlap"`
+
+	// OnError is the failure policy of the query: continue, disable (after MaxFailures consecutive failures) or fatal
+	OnError     string `yaml:"onerror"`
+	MaxFailures int    `yaml:"maxfailures"`
+	ErrorEvents *bool  `yaml:"errorevents"`
+
+	// FieldCase changes the case of the column names in the events: none, lower or snake
+	FieldCase string `yaml:"fieldcase"`
+}
+
+// DeltaConfig holds the __DELTA settings, the settings of a query override the global ones
+type DeltaConfig struct {
+	Wildcard    string `yaml:"wildcard"`
+	KeyWildcard string `yaml:"keywildcard"`
+
+	// ResetDetection detects counters reset by a server restart or FLUSH STATUS: decrease, uptime or none.
+	// Wraparound treats a decreasing counter as an unsigned 64-bit wraparound (unless the server restarted).
+	ResetDetection string `yaml:"resetdetection"`
+	Wraparound     *bool  `yaml:"wraparound"`
+
+	// Modes selects the delta mode of columns by name (rate, perminute, diff or change), Ratios adds ratios of two counters
+	Modes  map[string]string `yaml:"modes"`
+	Ratios []RatioConfig     `yaml:"ratios"`
+
+	// KeyTTL evicts the keys not seen for that many runs of the query (0 never does), MaxKeys caps the keys of a query
+	KeyTTL  *int `yaml:"keyttl"`
+	MaxKeys int  `yaml:"maxkeys"`
+
+	// Raw also sends the raw value of the delta columns and the interval of the delta (in seconds)
+	Raw *bool `yaml:"raw"`
+
+	// Naming names the delta fields flat (COM_SELECT_PERSECOND) or nested (COM_SELECT.rate),
+	// Fields overrides the name of a delta field (rate, perminute, diff, change, raw or interval) with a {name} template
+	Naming string            `yaml:"naming"`
+	Fields map[string]string `yaml:"fields"`
+}
+
+// RatioConfig is a ratio between the growth of two counter columns since the previous values (e.g. a hit rate)
+type RatioConfig struct {
+	Name        string `yaml:"name"`
+	Numerator   string `yaml:"numerator"`
+	Denominator string `yaml:"denominator"`
+}
+
+// Merge returns a copy of the delta settings with the non-empty settings of override applied
+func (d DeltaConfig) Merge(override DeltaConfig) DeltaConfig {
+	if override.Wildcard != "" {
+		d.Wildcard = override.Wildcard
+	}
+	if override.KeyWildcard != "" {
+		d.KeyWildcard = override.KeyWildcard
+	}
+	if override.ResetDetection != "" {
+		d.ResetDetection = override.ResetDetection
+	}
+	if override.Wraparound != nil {
+		d.Wraparound = override.Wraparound
+	}
+	if override.Modes != nil {
+		d.Modes = override.Modes
+	}
+	if override.Ratios != nil {
+		d.Ratios = override.Ratios
+	}
+	if override.KeyTTL != nil {
+		d.KeyTTL = override.KeyTTL
+	}
+	if override.MaxKeys != 0 {
+		d.MaxKeys = override.MaxKeys
+	}
+	if override.Raw != nil {
+		d.Raw = override.Raw
+	}
+	if override.Naming != "" {
+		d.Naming = override.Naming
+	}
+	if override.Fields != nil {
+		d.Fields = override.Fields
+	}
+	return d
+}
+
+// ResumeConfig holds the settings of a resume-multiple-rows query, they replace the {resume} placeholder.
+// A {index|default|column} placeholder in the SQL fills the settings that are left empty.
+// Columns is a composite cursor (e.g. updatedTime and id) for the {cursor} placeholder, starting from Defaults.
+type ResumeConfig struct {
+	Index    string   `yaml:"index"`
+	Default  string   `yaml:"default"`
+	Column   string   `yaml:"column"`
+	Columns  []string `yaml:"columns"`
+	Defaults []string `yaml:"defaults"`
+
+	// Types are the types the resume values are bound as, by resume column: auto (default), int, datetime or string
+	Types map[string]string `yaml:"types"`
+
+	// CatchUp reads page after page (of PageSize rows, the LIMIT of the SQL by default) until the query is caught up,
+	// or MaxRows rows were read, or MaxTime elapsed (the query period by default)
+	CatchUp  *bool  `yaml:"catchup"`
+	PageSize int    `yaml:"pagesize"`
+	MaxRows  int    `yaml:"maxrows"`
+	MaxTime  string `yaml:"maxtime"`
+}
+
+// UnmarshalYAML accepts both the legacy plain string form and the structured form of a query
+func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var sqlStr string
+	if err := unmarshal(&sqlStr); err == nil {
+		*q = QueryConfig{SQL: sqlStr}
+		return nil
+	}
+
+	type plainQueryConfig QueryConfig
+	return unmarshal((*plainQueryConfig)(q))
+}
+
+// IsEnabled returns false only if the query was explicitly disabled
+func (q QueryConfig) IsEnabled() bool {
+	return q.Enabled == nil || *q.Enabled
+}
+
+// Merge returns a copy of the query with the non-empty options of override applied
+func (q QueryConfig) Merge(override QueryConfig) QueryConfig {
+	if override.SQL != "" {
+		q.SQL = override.SQL
+	}
+	if override.Type != "" {
+		q.Type = override.Type
+	}
+	if override.Period != "" {
+		q.Period = override.Period
+	}
+	if override.Tags != nil {
+		q.Tags = override.Tags
+	}
+	q.Delta = q.Delta.Merge(override.Delta)
+	if override.Resume.Index != "" {
+		q.Resume.Index = override.Resume.Index
+	}
+	if override.Resume.Default != "" {
+		q.Resume.Default = override.Resume.Default
+	}
+	if override.Resume.Column != "" {
+		q.Resume.Column = override.Resume.Column
+	}
+	if override.Resume.Columns != nil {
+		q.Resume.Columns = override.Resume.Columns
+	}
+	if override.Resume.Defaults != nil {
+		q.Resume.Defaults = override.Resume.Defaults
+	}
+	if override.Resume.Types != nil {
+		q.Resume.Types = override.Resume.Types
+	}
+	if override.Resume.CatchUp != nil {
+		q.Resume.CatchUp = override.Resume.CatchUp
+	}
+	if override.Resume.PageSize != 0 {
+		q.Resume.PageSize = override.Resume.PageSize
+	}
+	if override.Resume.MaxRows != 0 {
+		q.Resume.MaxRows = override.Resume.MaxRows
+	}
+	if override.Resume.MaxTime != "" {
+		q.Resume.MaxTime = override.Resume.MaxTime
+	}
+	if override.Enabled != nil {
+		q.Enabled = override.Enabled
+	}
+	if override.Schedule != "" {
+		q.Schedule = override.Schedule
+	}
+	if override.Align != nil {
+		q.Align = override.Align
+	}
+	if override.Timeout != "" {
+		q.Timeout = override.Timeout
+	}
+	if override.MaxExecutionTime != nil {
+		q.MaxExecutionTime = override.MaxExecutionTime
+	}
+	if override.Columns != nil {
+		q.Columns = override.Columns
+	}
+	if override.Nulls != "" {
+		q.Nulls = override.Nulls
+	}
+	if override.NullDefaults != nil {
+		q.NullDefaults = override.NullDefaults
+	}
+	if override.Overlap != "" {
+		q.Overlap = override.Overlap
+	}
+	if override.OnError != "" {
+		q.OnError = override.OnError
+	}
+	if override.MaxFailures != 0 {
+		q.MaxFailures = override.MaxFailures
+	}
+	if override.ErrorEvents != nil {
+		q.ErrorEvents = override.ErrorEvents
+	}
+	if override.FieldCase != "" {
+		q.FieldCase = override.FieldCase
+	}
+	return q
 }
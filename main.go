@@ -10,6 +10,24 @@ import (
 )
 
 func main() {
+	// mysqlbeat delta dump prints the checkpointed delta values
+	if len(os.Args) > 1 && os.Args[1] == "delta" {
+		if err := beater.DeltaCommand(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// mysqlbeat resume list|set|reset|export|import inspects and edits the resume values
+	if len(os.Args) > 1 && os.Args[1] == "resume" {
+		if err := beater.ResumeCommand(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	err := beat.Run("mysqlbeat", "", beater.New())
 	if err != nil {
 		fmt.Println(err)